@@ -7,10 +7,13 @@ import (
 	"io"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/k1LoW/grpcstub/testdata/routeguide"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 func TestBidiStreaming(t *testing.T) {
@@ -134,3 +137,227 @@ func TestBidiStreamingUnmatched(t *testing.T) {
 		}
 	}
 }
+
+func TestBidiStreamingUnmatchedFallback(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Unmatched(func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		res := NewResponse()
+		res.Messages = append(res.Messages, Message{"message": "fallback"})
+		return res
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.RouteChat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.SendMsg(&routeguide.RouteNote{
+			Message: fmt.Sprintf("hello from client[%d]", i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "fallback"; res.Message != want {
+			t.Errorf("got %v\nwant %v", res.Message, want)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v\nwant %v", err, io.EOF)
+	}
+	{
+		got := len(ts.UnmatchedRequests())
+		if want := 2; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+}
+
+func TestBidiStreamingHeaderSentOnce(t *testing.T) {
+	tests := []struct {
+		name        string
+		firstHeader bool
+		want        []string
+	}{
+		{"header on the first response", true, []string{"header1", "header2"}},
+		{"header after the first response", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("RouteChat").Handler(func(r *Request) *Response {
+				res := NewResponse()
+				if tt.firstHeader || r.Message["message"] != "0" {
+					res.Headers.Append("hello", "header1", "header2")
+				}
+				res.Messages = []Message{{"message": r.Message["message"]}}
+				return res
+			})
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			stream, err := client.RouteChat(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			max := 3
+			for i := 0; i < max; i++ {
+				if err := stream.Send(&routeguide.RouteNote{Message: fmt.Sprintf("%d", i)}); err != nil {
+					t.Fatal(err)
+				}
+				res, err := stream.Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := res.Message, fmt.Sprintf("%d", i); got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+				t.Errorf("got %v\nwant %v", err, io.EOF)
+			}
+			h, err := stream.Header()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(h.Get("hello"), tt.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestBidiStreamingResponseInterval(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	interval := 50 * time.Millisecond
+	ts.Method("RouteChat").ResponseInterval(interval).Response(map[string]any{"message": "a"}).Response(map[string]any{"message": "b"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.RouteChat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&routeguide.RouteNote{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Since(start); got < interval/2 {
+		t.Errorf("got %v\nwant about %v", got, interval)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBidiHandler(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	// A stream is counted as one call regardless of the number of messages.
+	m := ts.Method("RouteChat").AssertExactCalls(2)
+	m.BidiHandler(func(s BidiStream) error {
+		// Reply with the running count of received messages.
+		c := 0
+		for {
+			r, err := s.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			c++
+			if err := s.Send(Message{"message": fmt.Sprintf("%s: %d", r.Message["message"], c)}); err != nil {
+				return err
+			}
+		}
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	for i := 0; i < 2; i++ {
+		stream, err := client.RouteChat(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 1; j <= 3; j++ {
+			if err := stream.Send(&routeguide.RouteNote{Message: "ping"}); err != nil {
+				t.Fatal(err)
+			}
+			res, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := res.Message, fmt.Sprintf("ping: %d", j); got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+			t.Errorf("got %v\nwant %v", err, io.EOF)
+		}
+	}
+
+	if got, want := len(ts.Requests()), 6; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(m.Requests()), 6; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestBidiHandlerError(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("RouteChat").BidiHandler(func(s BidiStream) error {
+		if _, err := s.Recv(); err != nil {
+			return err
+		}
+		return status.Error(codes.Aborted, "aborted")
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.RouteChat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&routeguide.RouteNote{Message: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	if got, want := status.Code(err), codes.Aborted; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
@@ -0,0 +1,38 @@
+package grpcstub
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// MatchCEL append matchFunc which evaluates the CEL expression to request matcher.
+// The request message is bound as `request` and the request matches when the expression evaluates to true.
+func (m *matcher) MatchCEL(expr string) *matcher {
+	env, err := cel.NewEnv(cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)))
+	if err != nil {
+		m.t.Fatalf("failed to create CEL environment: %v", err)
+		return m
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		m.t.Fatalf("failed to compile CEL expression %q: %v", expr, iss.Err())
+		return m
+	}
+	if !ast.OutputType().IsExactType(types.BoolType) && !ast.OutputType().IsExactType(types.DynType) {
+		m.t.Fatalf("CEL expression %q must evaluate to bool, but %s", expr, ast.OutputType())
+		return m
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		m.t.Fatalf("failed to create CEL program %q: %v", expr, err)
+		return m
+	}
+	return m.Match(func(r *Request) bool {
+		out, _, err := prg.Eval(map[string]any{"request": map[string]any(r.Message)})
+		if err != nil {
+			return false
+		}
+		b, ok := out.Value().(bool)
+		return ok && b
+	})
+}
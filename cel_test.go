@@ -0,0 +1,98 @@
+package grpcstub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/k1LoW/grpcstub/testdata/routeguide"
+)
+
+func TestMatchCEL(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").MatchCEL("request.latitude == 10 && request.longitude > 10").Response(map[string]any{"name": "hello"})
+	ts.Method("GetFeature").Response(map[string]any{"name": "default"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		p    *routeguide.Point
+		want string
+	}{
+		{&routeguide.Point{Latitude: 10, Longitude: 13}, "hello"},
+		{&routeguide.Point{Latitude: 10, Longitude: 3}, "default"},
+	}
+	for _, tt := range tests {
+		res, err := client.GetFeature(ctx, tt.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Name != tt.want {
+			t.Errorf("got %v\nwant %v", res.Name, tt.want)
+		}
+	}
+}
+
+func TestMatchCELNested(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("RouteChat").MatchCEL(`request.location.latitude > 0 && request.message != ""`).Response(map[string]any{"message": "matched"})
+	ts.Method("RouteChat").Response(map[string]any{"message": "default"})
+
+	tests := []struct {
+		note *routeguide.RouteNote
+		want string
+	}{
+		{&routeguide.RouteNote{Location: &routeguide.Point{Latitude: 1}, Message: "hello"}, "matched"},
+		{&routeguide.RouteNote{Location: &routeguide.Point{Latitude: 1}}, "default"},
+		{&routeguide.RouteNote{Message: "hello"}, "default"},
+	}
+	stream, err := routeguide.NewRouteGuideClient(ts.Conn()).RouteChat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if err := stream.Send(tt.note); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Message != tt.want {
+			t.Errorf("got %v\nwant %v", res.Message, tt.want)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchCELInvalid(t *testing.T) {
+	tests := []struct {
+		expr string
+	}{
+		{"request.latitude =="},
+		{"request.name + 'x'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			tb := &recordTB{}
+			m := ts.Method("GetFeature")
+			m.t = tb
+			m.MatchCEL(tt.expr)
+			if got, want := len(tb.errors), 1; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
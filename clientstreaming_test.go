@@ -2,9 +2,15 @@ package grpcstub
 
 import (
 	"context"
+	"errors"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 func TestClientStreaming(t *testing.T) {
@@ -47,6 +53,16 @@ func TestClientStreaming(t *testing.T) {
 			t.Errorf("got %v\nwant %v", got, want)
 		}
 	}
+
+	for i, r := range ts.Requests() {
+		got := &routeguide.Point{}
+		if err := proto.Unmarshal(r.Raw, got); err != nil {
+			t.Fatal(err)
+		}
+		if want := int32(i + 10); got.Latitude != want {
+			t.Errorf("got %v\nwant %v", got.Latitude, want)
+		}
+	}
 }
 
 func TestClientStreamingUnmatched(t *testing.T) {
@@ -91,3 +107,100 @@ func TestClientStreamingUnmatched(t *testing.T) {
 		}
 	}
 }
+
+func TestClientStreamHandler(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	called := 0
+	ts.Method("RecordRoute").ClientStreamHandler(func(rs []*Request) *Response {
+		called++
+		res := NewResponse()
+		res.Headers.Append("hello", "header1", "header2")
+		res.Messages = append(res.Messages, Message{"point_count": len(rs)})
+		return res
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.RecordRoute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := 3
+	for i := 0; i < c; i++ {
+		if err := stream.Send(&routeguide.Point{Latitude: int32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.PointCount, int32(c); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := called, 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	h, err := stream.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(h.Get("hello"), []string{"header1", "header2"}); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestClientStreamingNoMessages(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "unary"})
+	ts.Method("RecordRoute").Response(map[string]any{"point_count": 0, "distance": 1})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.RecordRoute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Distance, int32(1); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestClientStreamingValidateRequest(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("RecordRoute").ValidateRequest(func(r *Request, md protoreflect.MethodDescriptor) error {
+		if r.Message["latitude"] == float64(0) {
+			return errors.New("latitude is required")
+		}
+		return nil
+	}).Response(map[string]any{"point_count": 2})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.RecordRoute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*routeguide.Point{{Latitude: 1}, {Latitude: 0}} {
+		if err := stream.Send(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
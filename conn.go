@@ -0,0 +1,56 @@
+package grpcstub
+
+import (
+	"net"
+	"sync"
+)
+
+// ServeConn serves gRPC on conn in addition to the listener of the server.
+// The server performs the HTTP/2 ( and TLS if enabled ) handshake on conn, so the client must dial with the same credentials as Conn.
+// conn is closed when the server is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	l := newConnListener(conn)
+	go func() {
+		_ = s.getGRPCServer().Serve(l)
+	}()
+}
+
+var _ net.Listener = (*connListener)(nil)
+
+// connListener is a net.Listener which accepts only one connection.
+type connListener struct {
+	conn   net.Conn
+	connc  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{
+		conn:   conn,
+		connc:  make(chan net.Conn, 1),
+		closed: make(chan struct{}),
+	}
+	l.connc <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connc:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
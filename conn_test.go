@@ -0,0 +1,43 @@
+package grpcstub
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestServeConn(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	sc, cc := net.Pipe()
+	ts.ServeConn(sc)
+	conn, err := grpc.Dial("passthrough:///pipe",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return cc, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	client := routeguide.NewRouteGuideClient(conn)
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello"; res.Name != want {
+		t.Errorf("got %v\nwant %v", res.Name, want)
+	}
+}
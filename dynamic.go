@@ -1,6 +1,7 @@
 package grpcstub
 
 import (
+	"fmt"
 	"math/rand"
 	"strings"
 	"time"
@@ -48,6 +49,8 @@ func (m *matcher) ResponseDynamic(opts ...GeneratorOption) *matcher {
 	for _, opt := range opts {
 		gs = opt(gs)
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	prev := m.handler
 	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
 		var res *Response
@@ -143,10 +146,107 @@ func generateDynamicMessage(gs generators, r *Request, m protoreflect.MessageDes
 // ResponseDynamic set handler which return dynamic response.
 func (s *Server) ResponseDynamic(opts ...GeneratorOption) *matcher {
 	m := &matcher{
-		matchFuncs: []matchFunc{func(_ *Request) bool { return true }},
+		matchFuncs: []matchFunc{func(_ *Request, _ protoreflect.MethodDescriptor) bool { return true }},
+		server:     s,
+		t:          s.t,
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	m.index = len(s.matchers)
 	s.matchers = append(s.matchers, m)
 	return m.ResponseDynamic(opts...)
 }
+
+// ResponseDefault set handler which return default response generated from the schema of the output message.
+func (m *matcher) ResponseDefault() *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		res.Messages = append(res.Messages, generateDefaultMessage(md.Output(), 0))
+		return res
+	}
+	return m
+}
+
+func generateDefaultMessage(m protoreflect.MessageDescriptor, depth int) map[string]any {
+	const depthMax = 5
+	message := map[string]any{}
+	if depth > depthMax {
+		return message
+	}
+	oneofs := map[protoreflect.FullName]struct{}{}
+	for i := 0; i < m.Fields().Len(); i++ {
+		f := m.Fields().Get(i)
+		if o := f.ContainingOneof(); o != nil && !o.IsSynthetic() {
+			// Only one field of oneof can be set.
+			if _, ok := oneofs[o.FullName()]; ok {
+				continue
+			}
+			oneofs[o.FullName()] = struct{}{}
+		}
+		n := string(f.Name())
+		switch {
+		case f.IsMap():
+			k, ok := generateDefaultValue(f.MapKey(), depth)
+			if !ok {
+				continue
+			}
+			v, ok := generateDefaultValue(f.MapValue(), depth)
+			if !ok {
+				continue
+			}
+			message[n] = map[string]any{fmt.Sprintf("%v", k): v}
+		case f.IsList():
+			v, ok := generateDefaultValue(f, depth)
+			if !ok {
+				continue
+			}
+			message[n] = []any{v}
+		default:
+			v, ok := generateDefaultValue(f, depth)
+			if !ok {
+				continue
+			}
+			message[n] = v
+		}
+	}
+	return message
+}
+
+func generateDefaultValue(f protoreflect.FieldDescriptor, depth int) (any, bool) {
+	switch f.Kind() {
+	case protoreflect.DoubleKind, protoreflect.FloatKind:
+		return float64(0), true
+	case protoreflect.Int64Kind, protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind, protoreflect.Sint64Kind,
+		protoreflect.Int32Kind, protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind, protoreflect.Sint32Kind,
+		protoreflect.Uint64Kind, protoreflect.Uint32Kind:
+		return 0, true
+	case protoreflect.BoolKind:
+		return false, true
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return "", true
+	case protoreflect.EnumKind:
+		return int(f.Enum().Values().Get(0).Number()), true
+	case protoreflect.MessageKind:
+		switch f.Message().FullName() {
+		case "google.protobuf.Timestamp":
+			return time.Unix(0, 0).UTC().Format(time.RFC3339Nano), true
+		case "google.protobuf.Duration":
+			return "0s", true
+		}
+		if f.Message().ParentFile().Package() == "google.protobuf" {
+			// Other well-known types have special JSON representations, so leave them unset.
+			return nil, false
+		}
+		return generateDefaultMessage(f.Message(), depth+1), true
+	}
+	// Group type is deprecated and not supported in proto3.
+	return nil, false
+}
@@ -2,6 +2,7 @@ package grpcstub
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -113,3 +114,77 @@ func TestResponseDynamicServer(t *testing.T) {
 		t.Errorf("got %v\nwant %v", res.CreateTime.AsTime().UnixNano(), want.UnixNano())
 	}
 }
+
+func TestResponseDefault(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/hello.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("Hello").ResponseDefault()
+	client := hello.NewGrpcTestServiceClient(ts.Conn())
+	res, err := client.Hello(ctx, &hello.HelloRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Hellos), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := res.CreateTime.AsTime().Unix(), int64(0); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestResponseDefaultNested(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").ResponseDefault()
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Location == nil {
+		t.Error("want location")
+	}
+}
+
+func TestResponseDefaultWhileServing(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("GetFeature").ResponseDefault()
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	// Registering responses while requests are in flight must not race with the handler.
+	for len(ts.Requests()) < 10 {
+		m.ResponseDefault()
+		m.ResponseDynamic()
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+}
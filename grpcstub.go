@@ -8,9 +8,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"math/rand"
 	"net"
+	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -22,12 +27,19 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // register gzip compressor for Compress
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionv1alphapb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/dynamicpb"
@@ -48,6 +60,14 @@ const (
 	HealthCheckService_FLAPPING = "flapping"
 )
 
+const (
+	defaultHealthCheckFlapInterval = 100 * time.Millisecond
+	defaultGracefulTimeout         = 5 * time.Second
+)
+
+// defaultRequestMarshalOptions is protojson.MarshalOptions used to build Request.Message by default.
+var defaultRequestMarshalOptions = protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true, EmitUnpopulated: true}
+
 var _ TB = (testing.TB)(nil)
 
 type TB interface {
@@ -63,8 +83,39 @@ type Message map[string]any
 type Request struct {
 	Service string
 	Method  string
+	// Headers contains the transport-level headers `:authority`, `content-type`, `user-agent` and `grpc-accept-encoding` in addition to the client metadata.
+	// Other reserved headers ( `te`, `grpc-timeout`, `grpc-encoding` ) are stripped by grpc-go.
 	Headers metadata.MD
+	// Message is the request message decoded by protojson with unpopulated fields.
+	// Only the populated member of a oneof is contained, even if it has the zero value, and no member is contained if the oneof is unset.
+	// Enum values are contained as numbers ( float64 ) by default. Use MatchEnum to match them by name.
+	// The shape of Message ( e.g. field names and enum values ) can be changed by RequestMarshalOptions.
+	// The requests recorded by the server and matchers ( e.g. Requests ) are copies, so modifying Message in handlers does not affect them.
 	Message Message
+	// Peer is the address of the client. It may be empty for clients connected via Unix domain socket.
+	Peer string
+	// PeerCertificates is the verified certificate chain presented by the client when mutual TLS is enabled.
+	PeerCertificates []*x509.Certificate
+	// Raw is the request message in the protobuf wire format, re-encoded from the received message before the JSON conversion.
+	// Unknown fields are kept, but the field order may differ from the bytes sent by the client.
+	Raw []byte
+
+	ctx     context.Context
+	call    int
+	matcher *matcher
+}
+
+// MatchedBy returns the matcher which matched the request. It returns nil if no matcher matched the request.
+func (r *Request) MatchedBy() *matcher {
+	return r.matcher
+}
+
+// Context returns the context of the incoming call. It is done when the client cancels the call or the deadline of the call is exceeded.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
 }
 
 func (r Request) String() string {
@@ -90,21 +141,244 @@ func (r Request) String() string {
 	return strings.Join(s, "\n") + "\n"
 }
 
-func newRequest(md protoreflect.MethodDescriptor, message Message) *Request {
+// Struct returns the object ( e.g. google.protobuf.Struct ) at the dot-separated path of the request message.
+// Elements of arrays ( e.g. google.protobuf.ListValue ) can be specified by index.
+func (r *Request) Struct(path string) (map[string]any, bool) {
+	v, ok := r.Message.lookup(path)
+	if !ok {
+		return nil, false
+	}
+	st, ok := v.(map[string]any)
+	return st, ok
+}
+
+// clone returns a deep copy of the request, so that modifications by handlers do not affect the recorded requests.
+func (r *Request) clone() *Request {
+	c := *r
+	c.Headers = r.Headers.Copy()
+	if r.Message != nil {
+		c.Message = deepCopy(map[string]any(r.Message)).(map[string]any)
+	}
+	if r.Raw != nil {
+		c.Raw = append([]byte{}, r.Raw...)
+	}
+	return &c
+}
+
+func cloneRequests(rs []*Request) []*Request {
+	cs := make([]*Request, 0, len(rs))
+	for _, r := range rs {
+		cs = append(cs, r.clone())
+	}
+	return cs
+}
+
+// deepCopy returns a deep copy of the value decoded from JSON.
+func deepCopy(v any) any {
+	switch vv := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(vv))
+		for k, v := range vv {
+			m[k] = deepCopy(v)
+		}
+		return m
+	case []any:
+		l := make([]any, len(vv))
+		for i, v := range vv {
+			l[i] = deepCopy(v)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+// Header returns the first value of the header for the key. The key is case-insensitive.
+func (r *Request) Header(key string) string {
+	v := r.Headers.Get(key)
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+// HeaderValues returns all values of the header for the key. The key is case-insensitive.
+func (r *Request) HeaderValues(key string) []string {
+	return r.Headers.Get(key)
+}
+
+// HasHeader reports whether the request has the header for the key. The key is case-insensitive.
+func (r *Request) HasHeader(key string) bool {
+	return len(r.Headers.Get(key)) > 0
+}
+
+// As unmarshals the request message into m ( e.g. a generated message ) via protojson.
+// Unknown fields of the original request are not kept in Request.Message, so they are lost in the round trip,
+// and fields of Request.Message that m does not have cause an error.
+func (r *Request) As(m proto.Message) error {
+	b, err := json.Marshal(r.Message)
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(b, m)
+}
+
+func (m Message) lookup(path string) (any, bool) {
+	var v any = map[string]any(m)
+	for _, k := range strings.Split(path, ".") {
+		switch vv := v.(type) {
+		case map[string]any:
+			var ok bool
+			v, ok = vv[k]
+			if !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(vv) {
+				return nil, false
+			}
+			v = vv[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (s *Server) decodeRequestMessage(md protoreflect.MethodDescriptor, in proto.Message) (Message, error) {
+	b, err := s.requestMarshalOpts.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	m := Message{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if s.int64AsNumber {
+		convertInt64ToNumber(m, md.Input(), s.requestMarshalOpts.UseProtoNames)
+	}
+	return m, nil
+}
+
+// convertInt64ToNumber converts 64-bit integer fields ( including google.protobuf.Int64Value and google.protobuf.UInt64Value ) encoded as JSON strings by protojson into int64 or uint64.
+// Fields are keyed by the proto names if useProtoNames is true, otherwise by the JSON names.
+func convertInt64ToNumber(m map[string]any, d protoreflect.MessageDescriptor, useProtoNames bool) {
+	for i := 0; i < d.Fields().Len(); i++ {
+		f := d.Fields().Get(i)
+		key := f.JSONName()
+		if useProtoNames {
+			key = string(f.Name())
+		}
+		v, ok := m[key]
+		if !ok {
+			continue
+		}
+		switch {
+		case f.IsMap():
+			mm, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			for k, vv := range mm {
+				mm[k] = convertInt64ValueToNumber(f.MapValue(), vv, useProtoNames)
+			}
+		case f.IsList():
+			l, ok := v.([]any)
+			if !ok {
+				continue
+			}
+			for j, vv := range l {
+				l[j] = convertInt64ValueToNumber(f, vv, useProtoNames)
+			}
+		default:
+			m[key] = convertInt64ValueToNumber(f, v, useProtoNames)
+		}
+	}
+}
+
+func convertInt64ValueToNumber(f protoreflect.FieldDescriptor, v any, useProtoNames bool) any {
+	switch f.Kind() {
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if s, ok := v.(string); ok {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n
+			}
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if s, ok := v.(string); ok {
+			if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return n
+			}
+		}
+	case protoreflect.MessageKind:
+		switch f.Message().FullName() {
+		case "google.protobuf.Int64Value":
+			if s, ok := v.(string); ok {
+				if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+					return n
+				}
+			}
+		case "google.protobuf.UInt64Value":
+			if s, ok := v.(string); ok {
+				if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+					return n
+				}
+			}
+		default:
+			if mm, ok := v.(map[string]any); ok {
+				convertInt64ToNumber(mm, f.Message(), useProtoNames)
+			}
+		}
+	}
+	return v
+}
+
+func (s *Server) newRequestFromMessage(ctx context.Context, md protoreflect.MethodDescriptor, in proto.Message) (*Request, error) {
+	m, err := s.decodeRequestMessage(md, in)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	r := newRequest(ctx, md, m)
+	r.Raw = raw
+	return r, nil
+}
+
+func newRequest(ctx context.Context, md protoreflect.MethodDescriptor, message Message) *Request {
 	service, method := splitMethodFullName(md.FullName())
-	return &Request{
+	r := &Request{
 		Service: service,
 		Method:  method,
 		Headers: metadata.MD{},
 		Message: message,
+		ctx:     ctx,
+	}
+	if h, ok := metadata.FromIncomingContext(ctx); ok {
+		r.Headers = h
+		delete(r.Headers, inFlightStreamIDKey)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			r.Peer = p.Addr.String()
+		}
+		if ti, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(ti.State.VerifiedChains) > 0 {
+			r.PeerCertificates = ti.State.PeerCertificates
+		}
 	}
+	return r
 }
 
 type Response struct {
 	Headers  metadata.MD
 	Messages []Message
 	Trailers metadata.MD
-	Status   *status.Status
+	// Status is the status of the call. In server streaming and bidirectional streaming, it is returned after Messages are sent.
+	// In unary and client streaming, Messages are not sent if Status is not OK.
+	Status *status.Status
 }
 
 // NewResponse returns a new empty response
@@ -118,69 +392,244 @@ func NewResponse() *Response {
 }
 
 type Server struct {
-	matchers          []*matcher
-	fds               linker.Files
-	listener          net.Listener
-	server            *grpc.Server
-	tlsc              *tls.Config
-	cacert            []byte
-	cc                *grpc.ClientConn
-	requests          []*Request
-	unmatchedRequests []*Request
-	healthCheck       bool
-	disableReflection bool
-	status            serverStatus
-	t                 TB
-	mu                sync.RWMutex
+	matchers                 []*matcher
+	fds                      linker.Files
+	files                    *protoregistry.Files
+	listener                 net.Listener
+	server                   *grpc.Server
+	serverOpts               []grpc.ServerOption
+	tlsc                     *tls.Config
+	cacert                   []byte
+	cc                       *grpc.ClientConn
+	ccs                      []*grpc.ClientConn
+	requests                 []*Request
+	unmatchedRequests        []*Request
+	inFlight                 map[string]chan struct{}
+	inFlightSeq              uint64
+	inFlightLimited          bool
+	unmatched                handlerFunc
+	unmatchedStatus          *status.Status
+	defaultHeaders           metadata.MD
+	defaultTrailers          metadata.MD
+	onRequest                []func(r *Request)
+	onResponse               []func(r *Request, res *Response)
+	healthCheck              bool
+	healthSrv                *health.Server
+	healthCheckFlapInterval  time.Duration
+	disableReflection        bool
+	hideHealthFromReflection bool
+	unixSocket               string
+	streamNoMatchKeepOpen    bool
+	int64AsNumber            bool
+	requestMarshalOpts       protojson.MarshalOptions
+	gracefulTimeout          time.Duration
+	strict                   bool
+	maxSendMsgSize           int
+	expectationsAsserted     bool
+	status                   serverStatus
+	done                     chan struct{}
+	t                        TB
+	// lifecycle serializes Restart and shutdown. listener and server are replaced while holding both lifecycle and mu.
+	lifecycle sync.Mutex
+	mu        sync.RWMutex
 }
 
 type matcher struct {
-	matchFuncs []matchFunc
-	handler    handlerFunc
-	requests   []*Request
-	t          TB
-	mu         sync.RWMutex
+	matchFuncs          []matchFunc
+	constraints         []string
+	handler             handlerFunc
+	serverStreamHandler serverStreamHandlerFunc
+	clientStreamHandler clientStreamHandlerFunc
+	bidiStreamHandler   bidiStreamHandlerFunc
+	requests            []*Request
+	responses           []*Response
+	sentHeaders         []metadata.MD
+	sentTrailers        []metadata.MD
+	calls               int
+	limit               int
+	rnd                 *rand.Rand
+	priority            int
+	interval            time.Duration
+	maxInFlight         int
+	compressor          string
+	validators          []validateFunc
+	expectations        []callExpectation
+	server              *Server
+	index               int
+	t                   TB
+	mu                  sync.RWMutex
 }
 
-type matchFunc func(r *Request) bool
+type matchFunc func(r *Request, md protoreflect.MethodDescriptor) bool
 type handlerFunc func(r *Request, md protoreflect.MethodDescriptor) *Response
+type serverStreamHandlerFunc func(r *Request, s ServerStream) error
+type clientStreamHandlerFunc func(rs []*Request) *Response
+type bidiStreamHandlerFunc func(s BidiStream) error
+type validateFunc func(r *Request, md protoreflect.MethodDescriptor) error
+
+// callExpectation is an expectation of the number of calls of matcher.
+type callExpectation struct {
+	want string
+	fn   func(calls int) bool
+}
+
+// ServerStream is the server side of a server streaming RPC passed to the handler set by ServerStreamHandler.
+type ServerStream interface {
+	Context() context.Context
+	Send(m Message) error
+}
+
+type serverStream struct {
+	s      *Server
+	stream grpc.ServerStream
+	md     protoreflect.MethodDescriptor
+	res    *Response
+}
+
+// Context returns the context of the stream.
+func (ss *serverStream) Context() context.Context {
+	return ss.stream.Context()
+}
+
+// Send sends the message to the client.
+func (ss *serverStream) Send(m Message) error {
+	mes, err := ss.s.newResponseMessage(ss.md, m)
+	if err != nil {
+		return err
+	}
+	if err := ss.stream.SendMsg(mes); err != nil {
+		return err
+	}
+	ss.res.Messages = append(ss.res.Messages, m)
+	return nil
+}
+
+// BidiStream is the server side of a bidirectional streaming RPC passed to the handler set by BidiHandler.
+type BidiStream interface {
+	Context() context.Context
+	// Recv returns the next request of the stream, or io.EOF when the client closes sending.
+	Recv() (*Request, error)
+	Send(m Message) error
+}
+
+type bidiStream struct {
+	serverStream
+	m *matcher
+	// call is the number of the call of the stream counted by the matcher.
+	call int
+	// first is the request which matched the matcher and is returned by the first Recv.
+	first *Request
+}
+
+// Recv receives the next request from the client.
+// Received requests are recorded as requests of the server and the matcher, and validated by ValidateRequest.
+func (bs *bidiStream) Recv() (*Request, error) {
+	if r := bs.first; r != nil {
+		bs.first = nil
+		return r, nil
+	}
+	in := dynamicpb.NewMessage(bs.md.Input())
+	if err := bs.stream.RecvMsg(in); err != nil {
+		return nil, err
+	}
+	r, err := bs.s.newRequestFromMessage(bs.stream.Context(), bs.md, in)
+	if err != nil {
+		return nil, err
+	}
+	bs.s.callOnRequest(r)
+	bs.m.recordCall(bs.call, r)
+	bs.s.mu.Lock()
+	bs.s.requests = append(bs.s.requests, r.clone())
+	bs.s.mu.Unlock()
+	if res := bs.m.validate(bs.md, r); res != nil {
+		return nil, res.Status.Err()
+	}
+	return r, nil
+}
 
 // NewServer returns a new server with registered *grpc.Server
 func NewServer(t TB, protopath string, opts ...Option) *Server {
 	t.Helper()
-	ctx := context.Background()
-	c := &config{}
+	return NewServerWithContext(context.Background(), t, protopath, opts...)
+}
+
+// NewServerWithContext returns a new server with registered *grpc.Server.
+// The server is shut down when ctx is done, so Close is not required for long-running servers.
+func NewServerWithContext(ctx context.Context, t TB, protopath string, opts ...Option) *Server {
+	t.Helper()
+	s, err := newServer(ctx, t, protopath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newServer(ctx context.Context, t TB, protopath string, opts ...Option) (*Server, error) {
+	c := &config{
+		healthCheckFlapInterval: defaultHealthCheckFlapInterval,
+		gracefulTimeout:         defaultGracefulTimeout,
+		requestMarshalOpts:      defaultRequestMarshalOptions,
+	}
 	opts = append(opts, Proto(protopath))
 	for _, opt := range opts {
 		if err := opt(c); err != nil {
-			t.Fatal(err)
+			return nil, err
 		}
 	}
+	if c.clientCAs != nil && !c.useTLS {
+		return nil, errors.New("RequireClientCert requires UseTLS")
+	}
 	s := &Server{
-		t:                 t,
-		healthCheck:       c.healthCheck,
-		disableReflection: c.disableReflection,
+		t:                        t,
+		healthCheck:              c.healthCheck,
+		healthCheckFlapInterval:  c.healthCheckFlapInterval,
+		disableReflection:        c.disableReflection,
+		hideHealthFromReflection: c.hideHealthFromReflection,
+		unixSocket:               c.unixSocket,
+		streamNoMatchKeepOpen:    c.streamNoMatchKeepOpen,
+		int64AsNumber:            c.int64AsNumber,
+		requestMarshalOpts:       c.requestMarshalOpts,
+		gracefulTimeout:          c.gracefulTimeout,
+		maxSendMsgSize:           c.maxSendMsgSize,
+		done:                     make(chan struct{}),
 	}
-	if err := s.resolveProtos(ctx, c.importPaths, c.protos); err != nil {
-		t.Fatal(err)
+	importPaths := append(append([]string{}, c.importPaths...), c.protoImportPaths...)
+	if err := s.resolveProtos(ctx, importPaths, c.protos, c.compilerFuncs...); err != nil {
+		return nil, err
 	}
 	if c.useTLS {
 		certificate, err := tls.X509KeyPair(c.cert, c.key)
 		if err != nil {
-			t.Fatal(err)
+			return nil, err
 		}
 		tlsc := &tls.Config{
 			Certificates: []tls.Certificate{certificate},
 		}
+		if c.clientCAs != nil {
+			tlsc.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsc.ClientCAs = c.clientCAs
+		}
 		creds := credentials.NewTLS(tlsc)
 		s.tlsc = tlsc
 		s.cacert = c.cacert
-		s.server = grpc.NewServer(grpc.Creds(creds))
+		s.serverOpts = append([]grpc.ServerOption{grpc.Creds(creds)}, c.serverOpts...)
 	} else {
-		s.server = grpc.NewServer()
+		s.serverOpts = c.serverOpts
 	}
-	s.startServer()
-	return s
+	s.server = grpc.NewServer(s.serverOpts...)
+	if err := s.startServer(""); err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.shutdown(true)
+			case <-s.done:
+			}
+		}()
+	}
+	return s, nil
 }
 
 // NewTLSServer returns a new server with registered secure *grpc.Server
@@ -189,149 +638,608 @@ func NewTLSServer(t TB, proto string, cacert, cert, key []byte, opts ...Option)
 	return NewServer(t, proto, opts...)
 }
 
-// Close shuts down *grpc.Server
+// Close shuts down *grpc.Server gracefully.
+// If the graceful shutdown does not finish within the timeout set by GracefulTimeout ( default 5s ), *grpc.Server is stopped immediately.
+// Expectations of matchers are asserted unless AssertExpectations has been called.
 func (s *Server) Close() {
+	s.t.Helper()
+	s.mu.RLock()
+	asserted := s.expectationsAsserted
+	s.mu.RUnlock()
+	if !asserted {
+		s.AssertExpectations(s.t)
+	}
+	s.shutdown(true)
+}
+
+// Restart stops *grpc.Server immediately and starts a new one with the same services.
+// It listens on the same address if possible, otherwise on a new port ( see Addr ).
+// Matchers, recorded requests and health check statuses are kept.
+// Conns created by Conn are not closed and reconnect to the restarted server on the next call if the address is the same, while calls in flight fail with Unavailable.
+// It reports an error if the server is already closed.
+func (s *Server) Restart() {
+	s.t.Helper()
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if st := s.getStatus(); st == status_closing || st == status_closed {
+		s.t.Error("server is already closed")
+		return
+	}
+	l := s.getListener()
+	if l == nil {
+		s.t.Error("server is not started yet")
+		return
+	}
+	addr := ""
+	if s.unixSocket == "" {
+		addr = l.Addr().String()
+	}
+	s.getGRPCServer().Stop()
+	s.mu.Lock()
+	s.server = grpc.NewServer(s.serverOpts...)
+	s.mu.Unlock()
+	if err := s.startServer(addr); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// Stop shuts down *grpc.Server immediately without waiting for pending RPCs.
+func (s *Server) Stop() {
+	s.t.Helper()
+	s.shutdown(false)
+}
+
+// shutdown shuts down the server only once, even if Close, Stop and the cancellation of the context are called concurrently.
+func (s *Server) shutdown(graceful bool) {
+	s.t.Helper()
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	s.mu.Lock()
+	if s.status == status_closing || s.status == status_closed {
+		s.mu.Unlock()
+		return
+	}
 	s.status = status_closing
+	close(s.done)
+	s.mu.Unlock()
 	defer func() {
-		s.status = status_closed
+		s.setStatus(status_closed)
 	}()
-	s.t.Helper()
-	if s.listener == nil {
+	if s.getListener() == nil {
 		s.t.Error("server is not started yet")
 		return
 	}
-	if s.cc != nil {
-		_ = s.cc.Close()
-		s.cc = nil
+	s.CloseClientConn()
+	srv := s.getGRPCServer()
+	if graceful {
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		t := time.NewTimer(s.gracefulTimeout)
+		select {
+		case <-done:
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-t.C:
+			srv.Stop()
+		}
+	} else {
+		srv.Stop()
 	}
-	done := make(chan struct{})
-	go func() {
-		s.server.GracefulStop()
-		close(done)
-	}()
-	t := time.NewTimer(5 * time.Second)
-	select {
-	case <-done:
-		if !t.Stop() {
-			<-t.C
+	if s.unixSocket != "" {
+		if err := os.Remove(s.unixSocket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.t.Error(err)
 		}
-	case <-t.C:
-		s.server.Stop()
 	}
 }
 
+// Services returns the descriptors of services loaded from protos.
+func (s *Server) Services() []protoreflect.ServiceDescriptor {
+	var sds []protoreflect.ServiceDescriptor
+	for _, fd := range s.fds {
+		for i := 0; i < fd.Services().Len(); i++ {
+			sds = append(sds, fd.Services().Get(i))
+		}
+	}
+	return sds
+}
+
+// Methods returns the descriptors of methods of service ( e.g. package.Service ). It returns nil if the service is not found.
+func (s *Server) Methods(service string) []protoreflect.MethodDescriptor {
+	service = strings.TrimPrefix(service, "/")
+	for _, sd := range s.Services() {
+		if string(sd.FullName()) != service {
+			continue
+		}
+		var mds []protoreflect.MethodDescriptor
+		for i := 0; i < sd.Methods().Len(); i++ {
+			mds = append(mds, sd.Methods().Get(i))
+		}
+		return mds
+	}
+	return nil
+}
+
 // Addr returns server listener address
 func (s *Server) Addr() string {
 	s.t.Helper()
-	if s.listener == nil {
+	l := s.getListener()
+	if l == nil {
 		s.t.Error("server is not started yet")
 		return ""
 	}
-	return s.listener.Addr().String()
+	return l.Addr().String()
 }
 
-// Conn returns *grpc.ClientConn which connects *grpc.Server.
-func (s *Server) Conn() *grpc.ClientConn {
+// Host returns the host of server listener address. It returns "" for Unix domain socket.
+func (s *Server) Host() string {
 	s.t.Helper()
-	if s.listener == nil {
+	l := s.getListener()
+	if l == nil {
 		s.t.Error("server is not started yet")
-		return nil
+		return ""
 	}
-	var creds credentials.TransportCredentials
-	if s.tlsc == nil {
-		creds = insecure.NewCredentials()
-	} else {
-		if s.cacert == nil {
-			s.tlsc.InsecureSkipVerify = true
-		} else {
-			pool := x509.NewCertPool()
-			if ok := pool.AppendCertsFromPEM(s.cacert); !ok {
-				s.t.Fatal(errors.New("failed to append ca certs"))
-			}
-			s.tlsc.RootCAs = pool
-		}
-		creds = credentials.NewTLS(s.tlsc)
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return ""
 	}
-	conn, err := grpc.Dial(
-		s.listener.Addr().String(),
-		grpc.WithTransportCredentials(creds),
-	)
-	if err != nil {
-		s.t.Error(err)
+	return addr.IP.String()
+}
+
+// Port returns the port of server listener address. It returns 0 for Unix domain socket.
+func (s *Server) Port() int {
+	s.t.Helper()
+	l := s.getListener()
+	if l == nil {
+		s.t.Error("server is not started yet")
+		return 0
+	}
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+	return addr.Port
+}
+
+// Conn returns *grpc.ClientConn which connects *grpc.Server.
+// The conn is created once and shared by all calls without opts. If opts are given, it returns a new conn the same as NewConn.
+// The opts are appended after the transport credentials option and the max receive message size set by MaxSendMsgSize.
+// The conn is closed by CloseClientConn or Close.
+func (s *Server) Conn(opts ...grpc.DialOption) *grpc.ClientConn {
+	s.t.Helper()
+	if len(opts) > 0 {
+		return s.NewConn(opts...)
+	}
+	s.mu.RLock()
+	cc := s.cc
+	s.mu.RUnlock()
+	if cc != nil {
+		return cc
+	}
+	conn := s.dial()
+	if conn == nil {
 		return nil
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cc != nil {
+		// Another call created the shared conn first.
+		_ = conn.Close()
+		return s.cc
+	}
 	s.cc = conn
+	s.ccs = append(s.ccs, conn)
 	return conn
 }
 
-// ClientConn is alias of Conn
-func (s *Server) ClientConn() *grpc.ClientConn {
-	return s.Conn()
+// NewConn returns a new *grpc.ClientConn which connects *grpc.Server on each call.
+// The opts are appended after the transport credentials option and the max receive message size set by MaxSendMsgSize.
+// All conns are closed by CloseClientConn or Close.
+func (s *Server) NewConn(opts ...grpc.DialOption) *grpc.ClientConn {
+	s.t.Helper()
+	conn := s.dial(opts...)
+	if conn == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.ccs = append(s.ccs, conn)
+	s.mu.Unlock()
+	return conn
 }
 
-func (s *Server) startServer() {
-	s.status = status_starting
-	defer func() {
-		s.status = status_start
-	}()
+func (s *Server) dial(opts ...grpc.DialOption) *grpc.ClientConn {
 	s.t.Helper()
-	if !s.disableReflection {
-		reflection.Register(s.server)
+	if s.getListener() == nil {
+		s.t.Error("server is not started yet")
+		return nil
 	}
-	s.registerServer()
-	l, err := net.Listen("tcp", "127.0.0.1:0")
+	conn, err := s.DialContext(context.Background(), opts...)
 	if err != nil {
 		s.t.Error(err)
-		return
+		return nil
 	}
-	s.listener = l
-	go func() {
-		_ = s.server.Serve(l)
-	}()
+	return conn
 }
 
-// Match create request matcher with matchFunc (func(r *grpcstub.Request) bool).
-func (s *Server) Match(fn func(r *Request) bool) *matcher {
-	m := &matcher{
-		matchFuncs: []matchFunc{fn},
-		t:          s.t,
+// DialContext returns a new *grpc.ClientConn which connects *grpc.Server with the transport credentials of the server.
+// Unlike Conn, the returned conn is not closed by Close, so the caller must close it.
+// The opts are appended after the transport credentials option and the max receive message size set by MaxSendMsgSize.
+func (s *Server) DialContext(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	l := s.getListener()
+	if l == nil {
+		return nil, errors.New("server is not started yet")
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.matchers = append(s.matchers, m)
-	return m
+	creds := insecure.NewCredentials()
+	if s.tlsc != nil {
+		tlsc, err := s.clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsc)
+	}
+	dopts := []grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithChainStreamInterceptor(s.inFlightStreamInterceptor)}
+	if s.maxSendMsgSize > 0 {
+		dopts = append(dopts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(s.maxSendMsgSize)))
+	}
+	return grpc.DialContext(ctx, target(l), append(dopts, opts...)...)
 }
 
-// Match append matchFunc (func(r *grpcstub.Request) bool) to request matcher.
-func (m *matcher) Match(fn func(r *Request) bool) *matcher {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.matchFuncs = append(m.matchFuncs, fn)
-	return m
+// TLSConfig returns a clone of *tls.Config of the server. It returns nil if TLS is not enabled.
+func (s *Server) TLSConfig() *tls.Config {
+	if s.tlsc == nil {
+		return nil
+	}
+	return s.tlsc.Clone()
 }
 
-// Service create request matcher using service.
-func (s *Server) Service(service string) *matcher {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	fn := serviceMatchFunc(service)
+// CACert returns the CA certificate ( PEM ) set by UseTLS or NewTLSServer.
+func (s *Server) CACert() []byte {
+	return s.cacert
+}
+
+// clientTLSConfig returns *tls.Config for clients cloned from the config of the server, so that the config of the server is not mutated.
+func (s *Server) clientTLSConfig() (*tls.Config, error) {
+	tlsc := s.tlsc.Clone()
+	if s.cacert == nil {
+		tlsc.InsecureSkipVerify = true
+		return tlsc, nil
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(s.cacert); !ok {
+		return nil, errors.New("failed to append ca certs")
+	}
+	tlsc.RootCAs = pool
+	return tlsc, nil
+}
+
+// SetHealthStatus set serving status of the service of health check.
+func (s *Server) SetHealthStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	s.t.Helper()
+	if s.healthSrv == nil {
+		s.t.Error("health check is not enabled")
+		return
+	}
+	s.healthSrv.SetServingStatus(service, status)
+}
+
+// WaitHealthy waits until the service of health check reports SERVING, and returns false if timeout.
+func (s *Server) WaitHealthy(service string, timeout time.Duration) bool {
+	s.t.Helper()
+	if s.healthSrv == nil {
+		s.t.Error("health check is not enabled")
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		res, err := s.healthSrv.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err == nil && res.Status == healthpb.HealthCheckResponse_SERVING {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseClientConn closes all *grpc.ClientConn created by Conn and NewConn without stopping *grpc.Server.
+func (s *Server) CloseClientConn() {
+	s.mu.Lock()
+	ccs := s.ccs
+	s.cc = nil
+	s.ccs = nil
+	s.mu.Unlock()
+	for _, cc := range ccs {
+		_ = cc.Close()
+	}
+}
+
+// ClientConn is alias of Conn
+func (s *Server) ClientConn(opts ...grpc.DialOption) *grpc.ClientConn {
+	return s.Conn(opts...)
+}
+
+func (s *Server) setStatus(st serverStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = st
+}
+
+func (s *Server) getStatus() serverStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+// startServer registers the services and starts serving on addr. If addr is empty, it listens on the Unix domain socket or a random port of 127.0.0.1.
+func (s *Server) startServer(addr string) error {
+	s.setStatus(status_starting)
+	defer func() {
+		s.setStatus(status_start)
+	}()
+	s.t.Helper()
+	if !s.disableReflection {
+		ropts := reflection.ServerOptions{Services: s.server, DescriptorResolver: &fallbackResolver{files: s.files}}
+		if s.hideHealthFromReflection {
+			ropts.Services = &hiddenServices{
+				server: s.server,
+				hidden: []string{healthpb.Health_ServiceDesc.ServiceName},
+			}
+		}
+		// Register both v1 and v1alpha explicitly for legacy reflection clients which only query v1alpha.
+		reflectionv1alphapb.RegisterServerReflectionServer(s.server, reflection.NewServer(ropts))
+		reflectionpb.RegisterServerReflectionServer(s.server, reflection.NewServerV1(ropts))
+	}
+	s.registerServer()
+	var (
+		l   net.Listener
+		err error
+	)
+	switch {
+	case s.unixSocket != "":
+		l, err = net.Listen("unix", s.unixSocket)
+	case addr != "":
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			// Fall back to a new port if the address is taken.
+			l, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+	default:
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = l
+	srv := s.server
+	s.mu.Unlock()
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	return nil
+}
+
+func (s *Server) getListener() net.Listener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listener
+}
+
+// getGRPCServer returns *grpc.Server which is replaced by Restart.
+func (s *Server) getGRPCServer() *grpc.Server {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.server
+}
+
+// hiddenServices is reflection.ServiceInfoProvider which hides services from the list of reflection.
+type hiddenServices struct {
+	server *grpc.Server
+	hidden []string
+}
+
+func (h *hiddenServices) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := h.server.GetServiceInfo()
+	for _, name := range h.hidden {
+		delete(info, name)
+	}
+	return info
+}
+
+// fallbackResolver is protodesc.Resolver which looks up files first and then protoregistry.GlobalFiles ( e.g. for the reflection and health services ).
+type fallbackResolver struct {
+	files *protoregistry.Files
+}
+
+func (r *fallbackResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r *fallbackResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+func target(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return fmt.Sprintf("unix:%s", l.Addr().String())
+	}
+	return l.Addr().String()
+}
+
+// Match create request matcher with matchFunc (func(r *grpcstub.Request) bool).
+func (s *Server) Match(fn func(r *Request) bool) *matcher {
+	return s.MatchWithDescriptor(requestMatchFunc(fn))
+}
+
+// MatchWithDescriptor create request matcher with func(r *grpcstub.Request, md protoreflect.MethodDescriptor) bool.
+func (s *Server) MatchWithDescriptor(fn func(r *Request, md protoreflect.MethodDescriptor) bool) *matcher {
 	m := &matcher{
 		matchFuncs: []matchFunc{fn},
+		server:     s,
 		t:          s.t,
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.index = len(s.matchers)
+	s.matchers = append(s.matchers, m)
+	return m
+}
+
+// Match append matchFunc (func(r *grpcstub.Request) bool) to request matcher.
+func (m *matcher) Match(fn func(r *Request) bool) *matcher {
+	return m.MatchWithDescriptor(requestMatchFunc(fn))
+}
+
+// MatchWithDescriptor append func(r *grpcstub.Request, md protoreflect.MethodDescriptor) bool to request matcher.
+func (m *matcher) MatchWithDescriptor(fn func(r *Request, md protoreflect.MethodDescriptor) bool) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.matchFuncs = append(m.matchFuncs, fn)
+	return m
+}
+
+// MatchEnum create request matcher using the enum field at the dot-separated path of the request message.
+// The value can be either the name ( e.g. "COLOR_RED" ) or the number ( e.g. "1" ) of the enum value.
+func (s *Server) MatchEnum(path, value string) *matcher {
+	s.t.Helper()
+	return s.MatchWithDescriptor(enumMatchFunc(s, path, value))
+}
+
+// MatchEnum append request matcher using the enum field at the dot-separated path of the request message.
+// The value can be either the name ( e.g. "COLOR_RED" ) or the number ( e.g. "1" ) of the enum value.
+func (m *matcher) MatchEnum(path, value string) *matcher {
+	m.t.Helper()
+	return m.MatchWithDescriptor(enumMatchFunc(m.server, path, value))
+}
+
+// Any create request matcher which matches every request to any method.
+// The matcher has the lowest priority, so it can be registered first as the default and overridden by matchers registered after it.
+// Use Priority to change the priority.
+func (s *Server) Any() *matcher {
+	m := &matcher{
+		priority: math.MinInt,
+		server:   s,
+		t:        s.t,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.index = len(s.matchers)
+	s.matchers = append(s.matchers, m)
+	return m
+}
+
+// Service create request matcher using service.
+func (s *Server) Service(service string) *matcher {
+	s.t.Helper()
+	s.checkService(service)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn := serviceMatchFunc(service)
+	m := &matcher{
+		matchFuncs:  []matchFunc{fn},
+		constraints: []string{fmt.Sprintf("service=%s", service)},
+		server:      s,
+		t:           s.t,
+	}
+	m.index = len(s.matchers)
 	s.matchers = append(s.matchers, m)
 	return m
 }
 
 // Service append request matcher using service.
 func (m *matcher) Service(service string) *matcher {
+	m.t.Helper()
+	if m.server != nil {
+		m.server.checkService(service)
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	fn := serviceMatchFunc(service)
 	m.matchFuncs = append(m.matchFuncs, fn)
+	m.constraints = append(m.constraints, fmt.Sprintf("service=%s", service))
 	return m
 }
 
+// Strict makes Service and Method fail the test immediately when the service or the method is not registered.
+// By default, it is reported as the test error and the test continues.
+func (s *Server) Strict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strict = true
+}
+
+// checkService reports the error when service is not registered in the server.
+func (s *Server) checkService(service string) {
+	s.t.Helper()
+	s.checkRegistered(s.serviceError(service))
+}
+
+// checkMethod reports the error when method is not registered in the server.
+func (s *Server) checkMethod(method string) {
+	s.t.Helper()
+	s.checkRegistered(s.methodError(method))
+}
+
+func (s *Server) checkRegistered(err error) {
+	s.t.Helper()
+	if err == nil {
+		return
+	}
+	s.mu.RLock()
+	strict := s.strict
+	s.mu.RUnlock()
+	if strict {
+		s.t.Fatal(err)
+		return
+	}
+	s.t.Error(err)
+}
+
+// serviceError returns the error when service is not registered in the server.
+func (s *Server) serviceError(service string) error {
+	if _, ok := s.getGRPCServer().GetServiceInfo()[strings.TrimPrefix(service, "/")]; ok {
+		return nil
+	}
+	return fmt.Errorf("service %q is not registered", service)
+}
+
+// methodError returns the error when method is not registered in the server.
+// The method can be either the method name or `package.Service/Method`.
+func (s *Server) methodError(method string) error {
+	info := s.getGRPCServer().GetServiceInfo()
+	service, name := "", method
+	if strings.Contains(method, "/") {
+		fullname := strings.TrimPrefix(method, "/")
+		i := strings.LastIndex(fullname, "/")
+		service, name = fullname[:i], fullname[i+1:]
+	}
+	for sn, si := range info {
+		if service != "" && sn != service {
+			continue
+		}
+		for _, mi := range si.Methods {
+			if mi.Name == name {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("method %q is not registered", method)
+}
+
 // Servicef create request matcher using sprintf-ed service.
 func (s *Server) Servicef(format string, a ...any) *matcher {
 	return s.Service(fmt.Sprintf(format, a...))
@@ -344,23 +1252,33 @@ func (m *matcher) Servicef(format string, a ...any) *matcher {
 
 // Method create request matcher using method.
 func (s *Server) Method(method string) *matcher {
+	s.t.Helper()
+	s.checkMethod(method)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	fn := methodMatchFunc(method)
 	m := &matcher{
-		matchFuncs: []matchFunc{fn},
-		t:          s.t,
+		matchFuncs:  []matchFunc{fn},
+		constraints: []string{fmt.Sprintf("method=%s", method)},
+		server:      s,
+		t:           s.t,
 	}
+	m.index = len(s.matchers)
 	s.matchers = append(s.matchers, m)
 	return m
 }
 
 // Method append request matcher using method.
 func (m *matcher) Method(method string) *matcher {
+	m.t.Helper()
+	if m.server != nil {
+		m.server.checkMethod(method)
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	fn := methodMatchFunc(method)
 	m.matchFuncs = append(m.matchFuncs, fn)
+	m.constraints = append(m.constraints, fmt.Sprintf("method=%s", method))
 	return m
 }
 
@@ -374,8 +1292,513 @@ func (m *matcher) Methodf(format string, a ...any) *matcher {
 	return m.Method(fmt.Sprintf(format, a...))
 }
 
-// Header append handler which append header to response.
-func (m *matcher) Header(key, value string) *matcher {
+// Unary append request matcher which matches requests to unary methods.
+func (m *matcher) Unary() *matcher {
+	return m.MatchWithDescriptor(func(_ *Request, md protoreflect.MethodDescriptor) bool {
+		return !md.IsStreamingClient() && !md.IsStreamingServer()
+	})
+}
+
+// ClientStreaming append request matcher which matches requests to client streaming methods ( including bidirectional streaming methods ).
+func (m *matcher) ClientStreaming() *matcher {
+	return m.MatchWithDescriptor(func(_ *Request, md protoreflect.MethodDescriptor) bool {
+		return md.IsStreamingClient()
+	})
+}
+
+// ServerStreaming append request matcher which matches requests to server streaming methods ( including bidirectional streaming methods ).
+func (m *matcher) ServerStreaming() *matcher {
+	return m.MatchWithDescriptor(func(_ *Request, md protoreflect.MethodDescriptor) bool {
+		return md.IsStreamingServer()
+	})
+}
+
+// AssertExactCalls append expectation that matcher is called exactly n times.
+// The expectation is asserted by Server.AssertExpectations or Server.Close.
+func (m *matcher) AssertExactCalls(n int) *matcher {
+	return m.expect(fmt.Sprintf("exactly %d", n), func(calls int) bool {
+		return calls == n
+	})
+}
+
+// AssertMinCalls append expectation that matcher is called at least n times.
+// The expectation is asserted by Server.AssertExpectations or Server.Close.
+func (m *matcher) AssertMinCalls(n int) *matcher {
+	return m.expect(fmt.Sprintf("at least %d", n), func(calls int) bool {
+		return calls >= n
+	})
+}
+
+// AssertMaxCalls append expectation that matcher is called at most n times.
+// The expectation is asserted by Server.AssertExpectations or Server.Close.
+func (m *matcher) AssertMaxCalls(n int) *matcher {
+	return m.expect(fmt.Sprintf("at most %d", n), func(calls int) bool {
+		return calls <= n
+	})
+}
+
+// Times set the number of calls the matcher can match. After n calls, requests fall through to the next matcher.
+func (m *matcher) Times(n int) *matcher {
+	if n <= 0 {
+		m.t.Fatalf("invalid times: %d", n)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limit = n
+	return m
+}
+
+// Once set the matcher to match only the first call. It is the same as Times(1).
+func (m *matcher) Once() *matcher {
+	return m.Times(1)
+}
+
+func (m *matcher) expect(want string, fn func(calls int) bool) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expectations = append(m.expectations, callExpectation{want: want, fn: fn})
+	return m
+}
+
+// String returns the registration order and the service and method constraints of matcher ( e.g. "matcher[0] (method=GetFeature)" ).
+func (m *matcher) String() string {
+	return fmt.Sprintf("matcher[%d] %s", m.index, m.describe())
+}
+
+// describe returns the service and method constraints of matcher.
+func (m *matcher) describe() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.constraints) == 0 {
+		return "(no service or method constraints)"
+	}
+	return fmt.Sprintf("(%s)", strings.Join(m.constraints, ", "))
+}
+
+func (m *matcher) unmetExpectations() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var msgs []string
+	for _, e := range m.expectations {
+		if !e.fn(m.calls) {
+			msgs = append(msgs, fmt.Sprintf("called %d times, want %s", m.calls, e.want))
+		}
+	}
+	return msgs
+}
+
+// Priority set priority of matcher. Matchers are evaluated in descending order of priority, and in registration order within the same priority.
+// The default priority is 0.
+func (m *matcher) Priority(n int) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.priority = n
+	return m
+}
+
+// Compress set the compressor ( e.g. "gzip" ) of responses. The compressor must be registered by encoding.RegisterCompressor and supported by the client.
+// If the client does not support the compressor, it reports the test error and returns Internal.
+func (m *matcher) Compress(name string) *matcher {
+	if name != encoding.Identity && encoding.GetCompressor(name) == nil {
+		m.t.Fatalf("compressor %q is not registered", name)
+		return m
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compressor = name
+	return m
+}
+
+// ResponseInterval set the interval between messages sent by server streaming and bidirectional streaming.
+// The call returns the status of the context error when the stream is done while waiting.
+func (m *matcher) ResponseInterval(d time.Duration) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.interval = d
+	return m
+}
+
+// MaxInFlight limits the number of messages of server streaming which are sent but not received by the client yet to n.
+// Sending more messages waits until the client receives messages, so slow consumers can be simulated by not reading the stream.
+// The received messages are reported by the conns created by the server ( e.g. Conn, NewConn and DialContext ) with the x-grpcstub-stream-id header,
+// so the stream from other clients ( e.g. grpc.Dial with Addr ) is reported as the test error and not limited.
+func (m *matcher) MaxInFlight(n int) *matcher {
+	if n <= 0 {
+		m.t.Fatalf("invalid max in flight: %d", n)
+	}
+	if m.server != nil {
+		m.server.mu.Lock()
+		m.server.inFlightLimited = true
+		m.server.mu.Unlock()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxInFlight = n
+	return m
+}
+
+// ValidateRequest append validator of requests. When fn returns an error, the handlers are not called and the call returns InvalidArgument with the error message.
+// If the error is a gRPC status error ( e.g. created by status.Error ), its status is returned as is.
+// In client streaming, fn is called for each request received in the stream.
+func (m *matcher) ValidateRequest(fn func(r *Request, md protoreflect.MethodDescriptor) error) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.validators = append(m.validators, fn)
+	return m
+}
+
+// Header append handler which append header to response.
+func (m *matcher) Header(key, value string) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		res.Headers.Append(key, value)
+		return res
+	}
+	return m
+}
+
+// Trailer append handler which append trailer to response.
+// Trailers are sent with the status even if no message is sent ( e.g. trailers-only error responses ).
+func (m *matcher) Trailer(key, value string) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		res.Trailers.Append(key, value)
+		return res
+	}
+	return m
+}
+
+// EchoHeader append handler which append the request header of key to response headers.
+func (m *matcher) EchoHeader(key string) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		if v := r.HeaderValues(key); len(v) > 0 {
+			res.Headers.Append(key, v...)
+		}
+		return res
+	}
+	return m
+}
+
+// EchoTrailer append handler which append the request header of key to response trailers.
+func (m *matcher) EchoTrailer(key string) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		if v := r.HeaderValues(key); len(v) > 0 {
+			res.Trailers.Append(key, v...)
+		}
+		return res
+	}
+	return m
+}
+
+// RequireHeader append handler which return Unauthenticated and report the test error when the request does not have the header of key.
+func (m *matcher) RequireHeader(key string) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		if len(r.Headers.Get(key)) == 0 {
+			m.t.Errorf("required header %q is missing in the request to %s/%s", key, r.Service, r.Method)
+			res.Status = status.Newf(codes.Unauthenticated, "%s: required header %q is missing", codes.Unauthenticated.String(), key)
+		}
+		return res
+	}
+	return m
+}
+
+// Handler set handler
+func (m *matcher) Handler(fn func(r *Request) *Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		return fn(r)
+	}
+}
+
+// HandlerContext set handler with the context of the incoming call.
+func (m *matcher) HandlerContext(fn func(ctx context.Context, r *Request) *Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		return fn(r.Context(), r)
+	}
+}
+
+// HangUntilDeadlineExceeded set handler which block until the context of the incoming call is done and return DeadlineExceeded.
+func (m *matcher) HangUntilDeadlineExceeded() {
+	m.HandlerContext(func(ctx context.Context, r *Request) *Response {
+		<-ctx.Done()
+		res := NewResponse()
+		res.Status = status.New(codes.DeadlineExceeded, codes.DeadlineExceeded.String())
+		return res
+	})
+}
+
+// ServerStreamHandler set handler for server streaming which sends messages via ServerStream.
+// If the handler returns an error, it is returned to the client as is.
+// ServerStream.Send blocks while the flow control window of the client is full.
+// Use MaxInFlight to limit the messages not received by the client explicitly.
+func (m *matcher) ServerStreamHandler(fn func(r *Request, s ServerStream) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.serverStreamHandler = fn
+}
+
+// ResponseWriter set handler for server streaming which forwards messages sent to the returned StreamWriter until it is closed.
+// The call ends with OK status when the StreamWriter is closed, and stops forwarding when the client disconnects.
+func (m *matcher) ResponseWriter() *StreamWriter {
+	w := &StreamWriter{
+		ch:     make(chan Message),
+		closed: make(chan struct{}),
+	}
+	m.ServerStreamHandler(func(r *Request, s ServerStream) error {
+		for {
+			select {
+			case msg := <-w.ch:
+				if err := s.Send(msg); err != nil {
+					return err
+				}
+			case <-w.closed:
+				return nil
+			case <-s.Context().Done():
+				return status.FromContextError(s.Context().Err()).Err()
+			}
+		}
+	})
+	return w
+}
+
+// StreamWriter is the writer returned by matcher.ResponseWriter.
+// If multiple calls are streaming at the same time, each message is forwarded to one of them.
+type StreamWriter struct {
+	ch     chan Message
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Send sends the message to the streaming call. It blocks until a streaming call receives the message.
+// It returns an error if the StreamWriter is closed.
+func (w *StreamWriter) Send(msg Message) error {
+	return w.SendContext(context.Background(), msg)
+}
+
+// SendContext is the same as Send, but it returns the error of ctx when ctx is done before a streaming call receives the message.
+func (w *StreamWriter) SendContext(ctx context.Context, msg Message) error {
+	select {
+	case <-w.closed:
+		return errors.New("stream writer is closed")
+	default:
+	}
+	select {
+	case w.ch <- msg:
+		return nil
+	case <-w.closed:
+		return errors.New("stream writer is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the StreamWriter and ends the streaming calls.
+func (w *StreamWriter) Close() {
+	w.once.Do(func() {
+		close(w.closed)
+	})
+}
+
+// ClientStreamHandler set handler for client streaming which is called once with all requests received in the stream.
+// The first message of the returned response is sent as the only response of the stream.
+func (m *matcher) ClientStreamHandler(fn func(rs []*Request) *Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clientStreamHandler = fn
+}
+
+// BidiHandler set handler for bidirectional streaming which is called once per stream ( e.g. for stateful protocols such as ping-pong ).
+// The matcher is matched with the first request of the stream, which is returned by the first BidiStream.Recv.
+// If the handler returns an error, it is returned to the client as is, otherwise the stream ends with OK status.
+func (m *matcher) BidiHandler(fn func(s BidiStream) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bidiStreamHandler = fn
+}
+
+// Response set handler which return response.
+// In the map, nil ( JSON null ) leaves the field unset and the zero value sets the field explicitly ( e.g. for optional fields and wrappers ).
+// Values of bytes fields can be []byte or base64-encoded strings.
+// Fields which do not exist in the response message ( e.g. typos ) are reported as test errors and the call fails.
+func (m *matcher) Response(message any) *matcher {
+	mm := map[string]any{}
+	switch v := message.(type) {
+	case map[string]any:
+		mm = v
+	case proto.Message:
+		// protojson preserves field presence of optional fields and wrappers
+		b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(v)
+		if err != nil {
+			m.t.Fatalf("failed to convert message: %v", err)
+		}
+		if err := json.Unmarshal(b, &mm); err != nil {
+			m.t.Fatalf("failed to convert message: %v", err)
+		}
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			m.t.Fatalf("failed to convert message: %v", err)
+		}
+		if err := json.Unmarshal(b, &mm); err != nil {
+			m.t.Fatalf("failed to convert message: %v", err)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		res.Messages = append(res.Messages, mm)
+		return res
+	}
+	return m
+}
+
+// ResponseProto set handler which return response of the generated message.
+// If the message type does not match the output type of the method, it reports the test error and returns Internal.
+func (m *matcher) ResponseProto(msg proto.Message) *matcher {
+	if msg == nil {
+		m.t.Fatalf("failed to set response: message is nil")
+		return m
+	}
+	name := msg.ProtoReflect().Descriptor().FullName()
+	m.Response(msg)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		res := prev(r, md)
+		if want := md.Output().FullName(); name != want {
+			m.t.Errorf("response message type of %s/%s is %s, want %s", r.Service, r.Method, name, want)
+			// Drop the messages so that streaming does not send them before the status.
+			res.Messages = nil
+			res.Status = status.Newf(codes.Internal, "%s: response message type is %s, want %s", codes.Internal.String(), name, want)
+		}
+		return res
+	}
+	return m
+}
+
+// ResponseString set handler which return response.
+func (m *matcher) ResponseString(message string) *matcher {
+	mes := make(map[string]any)
+	_ = json.Unmarshal([]byte(message), &mes)
+	return m.Response(mes)
+}
+
+// ResponseStringf set handler which return sprintf-ed response.
+func (m *matcher) ResponseStringf(format string, a ...any) *matcher {
+	return m.ResponseString(fmt.Sprintf(format, a...))
+}
+
+// Flaky append handler which return response with st with probability p per call.
+// Otherwise it returns the response of the other handlers. The random source can be seeded by FlakySeed for reproducible tests.
+func (m *matcher) Flaky(p float64, st *status.Status) *matcher {
+	if p < 0 || p > 1 {
+		m.t.Fatalf("invalid probability: %v", p)
+		return m
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		m.mu.Lock()
+		if m.rnd == nil {
+			m.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		fail := m.rnd.Float64() < p
+		m.mu.Unlock()
+		if fail {
+			res.Status = st
+		}
+		return res
+	}
+	return m
+}
+
+// FlakySeed set seed of the random source used by Flaky.
+func (m *matcher) FlakySeed(seed int64) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rnd = rand.New(rand.NewSource(seed))
+	return m
+}
+
+// ResponseSequence set handler which return messages in order, messages[0] on the first call matched by the matcher, messages[1] on the second and so on.
+// After messages are exhausted, it returns ResourceExhausted.
+func (m *matcher) ResponseSequence(messages ...Message) *matcher {
+	return m.responseSequence(false, messages...)
+}
+
+// ResponseSequenceRepeatLast set handler which return messages in order like ResponseSequence, but keep returning the last message after messages are exhausted.
+func (m *matcher) ResponseSequenceRepeatLast(messages ...Message) *matcher {
+	return m.responseSequence(true, messages...)
+}
+
+func (m *matcher) responseSequence(repeatLast bool, messages ...Message) *matcher {
+	if len(messages) == 0 {
+		m.t.Fatalf("failed to set response sequence: no messages")
+		return m
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	prev := m.handler
 	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
 		var res *Response
@@ -384,14 +1807,41 @@ func (m *matcher) Header(key, value string) *matcher {
 		} else {
 			res = prev(r, md)
 		}
-		res.Headers.Append(key, value)
+		i := r.call - 1
+		if i >= len(messages) {
+			if !repeatLast {
+				res.Status = status.Newf(codes.ResourceExhausted, "%s: response sequence of %d messages is exhausted", codes.ResourceExhausted.String(), len(messages))
+				return res
+			}
+			i = len(messages) - 1
+		}
+		res.Messages = append(res.Messages, map[string]any(messages[i]))
 		return res
 	}
 	return m
 }
 
-// Trailer append handler which append trailer to response.
-func (m *matcher) Trailer(key, value string) *matcher {
+// ResponseTable set handler which return the message of table selected by the value of field ( dot-separated path ) of request.
+// Keys are compared with the value in the same way as ResponseByField ( e.g. int64(1) and "1" are the same key ),
+// and the message of nil key is returned when no key matches or the value is not scalar ( e.g. message and list ).
+// If no key matches and there is no nil key, it returns NotFound.
+func (m *matcher) ResponseTable(field string, table map[any]Message) *matcher {
+	rows := map[string]Message{}
+	var def Message
+	for k, v := range table {
+		if k == nil {
+			def = v
+			continue
+		}
+		key, ok := fieldKey(k)
+		if !ok {
+			m.t.Fatalf("invalid key of ResponseTable: %v ( %T )", k, k)
+			return m
+		}
+		rows[key] = v
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	prev := m.handler
 	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
 		var res *Response
@@ -400,34 +1850,34 @@ func (m *matcher) Trailer(key, value string) *matcher {
 		} else {
 			res = prev(r, md)
 		}
-		res.Trailers.Append(key, value)
+		v, _ := r.Message.lookup(field)
+		var (
+			mes Message
+			ok  bool
+		)
+		if key, scalar := fieldKey(v); scalar && v != nil {
+			mes, ok = rows[key]
+		}
+		if !ok && def != nil {
+			mes, ok = def, true
+		}
+		if !ok {
+			res.Status = status.Newf(codes.NotFound, "%s: no row for %s=%v", codes.NotFound.String(), field, v)
+			return res
+		}
+		res.Messages = append(res.Messages, map[string]any(mes))
 		return res
 	}
 	return m
 }
 
-// Handler set handler
-func (m *matcher) Handler(fn func(r *Request) *Response) {
-	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
-		return fn(r)
-	}
-}
-
-// Response set handler which return response.
-func (m *matcher) Response(message any) *matcher {
-	mm := map[string]any{}
-	switch v := message.(type) {
-	case map[string]any:
-		mm = v
-	default:
-		b, err := json.Marshal(v)
-		if err != nil {
-			m.t.Fatalf("failed to convert message: %v", err)
-		}
-		if err := json.Unmarshal(b, &mm); err != nil {
-			m.t.Fatalf("failed to convert message: %v", err)
-		}
-	}
+// ResponseByField set handler which return the message of responses keyed by the string value of field ( dot-separated path ) of request.
+// Numbers are formatted in decimal ( e.g. "1" and "0.5" ), so 64-bit integers encoded as strings by protojson and decoded as numbers by Int64AsNumber have the same key.
+// The message of key "*" is returned when no key matches or the value is not scalar ( e.g. message and list ).
+// If no key matches and there is no "*" key, it returns NotFound.
+func (m *matcher) ResponseByField(path string, responses map[string]Message) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	prev := m.handler
 	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
 		var res *Response
@@ -436,26 +1886,34 @@ func (m *matcher) Response(message any) *matcher {
 		} else {
 			res = prev(r, md)
 		}
-		res.Messages = append(res.Messages, mm)
+		v, _ := r.Message.lookup(path)
+		key, scalar := fieldKey(v)
+		var (
+			mes Message
+			ok  bool
+		)
+		if scalar {
+			mes, ok = responses[key]
+		} else {
+			key = fmt.Sprint(v)
+		}
+		if !ok {
+			mes, ok = responses["*"]
+		}
+		if !ok {
+			res.Status = status.Newf(codes.NotFound, "%s: no response for %s=%s", codes.NotFound.String(), path, key)
+			return res
+		}
+		res.Messages = append(res.Messages, map[string]any(mes))
 		return res
 	}
 	return m
 }
 
-// ResponseString set handler which return response.
-func (m *matcher) ResponseString(message string) *matcher {
-	mes := make(map[string]any)
-	_ = json.Unmarshal([]byte(message), &mes)
-	return m.Response(mes)
-}
-
-// ResponseStringf set handler which return sprintf-ed response.
-func (m *matcher) ResponseStringf(format string, a ...any) *matcher {
-	return m.ResponseString(fmt.Sprintf(format, a...))
-}
-
 // Status set handler which return response with status
 func (m *matcher) Status(s *status.Status) *matcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	prev := m.handler
 	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
 		var res *Response
@@ -470,6 +1928,51 @@ func (m *matcher) Status(s *status.Status) *matcher {
 	return m
 }
 
+// StatusCode set handler which return response with status of code and msg.
+func (m *matcher) StatusCode(code codes.Code, msg string) *matcher {
+	return m.Status(status.New(code, msg))
+}
+
+// StatusWithDetails set handler which return response with status of code and msg with details.
+func (m *matcher) StatusWithDetails(code codes.Code, msg string, details ...proto.Message) *matcher {
+	var v1s []protoadapt.MessageV1
+	for _, d := range details {
+		v1s = append(v1s, protoadapt.MessageV1Of(d))
+	}
+	st, err := status.New(code, msg).WithDetails(v1s...)
+	if err != nil {
+		m.t.Fatalf("failed to attach details: %v", err)
+	}
+	return m.Status(st)
+}
+
+// ResponseErrorf set handler which return response with sprintf-ed error status.
+func (m *matcher) ResponseErrorf(code codes.Code, format string, a ...any) *matcher {
+	return m.Status(status.Newf(code, format, a...))
+}
+
+// Unmatched set fallback handler which is called when no matcher matches the request.
+// If no fallback handler is set, the server returns the status set by UnmatchedStatus.
+func (s *Server) Unmatched(fn func(r *Request, md protoreflect.MethodDescriptor) *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unmatched = fn
+}
+
+// UnmatchedStatus set status which is returned when no matcher and no fallback handler match the request.
+// The default is Unimplemented so that it is not confused with NotFound returned by matchers.
+// If msg is empty, the message is "<code>: no matcher for <service>/<method>".
+func (s *Server) UnmatchedStatus(code codes.Code, msg string) {
+	s.t.Helper()
+	if code == codes.OK {
+		s.t.Fatalf("UnmatchedStatus requires non-OK code")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unmatchedStatus = status.New(code, msg)
+}
+
 // Requests returns []*grpcstub.Request received by router.
 func (s *Server) Requests() []*Request {
 	s.mu.RLock()
@@ -477,6 +1980,149 @@ func (s *Server) Requests() []*Request {
 	return s.requests
 }
 
+// RequestsForService returns []*grpcstub.Request of service received by router.
+func (s *Server) RequestsForService(service string) []*Request {
+	return s.filterRequests(serviceMatchFunc(service))
+}
+
+// RequestsForMethod returns []*grpcstub.Request of service/method received by router.
+func (s *Server) RequestsForMethod(service, method string) []*Request {
+	return s.filterRequests(serviceMatchFunc(service), methodMatchFunc(method))
+}
+
+func (s *Server) filterRequests(fns ...matchFunc) []*Request {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var rs []*Request
+L:
+	for _, r := range s.requests {
+		for _, fn := range fns {
+			if !fn(r, nil) {
+				continue L
+			}
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// DefaultHeader append header which is sent in all responses of the matchers and the fallback handler.
+// Headers of the same key set by the matcher take precedence over the default header.
+func (s *Server) DefaultHeader(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.defaultHeaders == nil {
+		s.defaultHeaders = metadata.MD{}
+	}
+	s.defaultHeaders.Append(key, value)
+}
+
+// DefaultTrailer append trailer which is sent in all responses of the matchers and the fallback handler.
+// Trailers of the same key set by the matcher take precedence over the default trailer.
+func (s *Server) DefaultTrailer(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.defaultTrailers == nil {
+		s.defaultTrailers = metadata.MD{}
+	}
+	s.defaultTrailers.Append(key, value)
+}
+
+// withDefaultMetadata returns a copy of res with the default headers and trailers of the keys which res does not have.
+func (s *Server) withDefaultMetadata(res *Response) *Response {
+	s.mu.RLock()
+	headers := s.defaultHeaders.Copy()
+	trailers := s.defaultTrailers.Copy()
+	s.mu.RUnlock()
+	if len(headers) == 0 && len(trailers) == 0 {
+		return res
+	}
+	c := *res
+	c.Headers = mergeMetadata(res.Headers, headers)
+	c.Trailers = mergeMetadata(res.Trailers, trailers)
+	return &c
+}
+
+// mergeMetadata returns a copy of md with the values of defaults for the keys which md does not have.
+func mergeMetadata(md, defaults metadata.MD) metadata.MD {
+	merged := md.Copy()
+	for k, v := range defaults {
+		if _, ok := merged[k]; ok {
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// OnRequest append callback which is called with every received request before matching.
+// Callbacks are called without holding the lock of the server, so they can call methods of the server.
+func (s *Server) OnRequest(fn func(r *Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRequest = append(s.onRequest, fn)
+}
+
+// OnResponse append callback which is called with the request and the response chosen for it.
+// For client streaming, the request is the last received request. If no matcher and no fallback handler match, the response has the status set by UnmatchedStatus.
+// Callbacks are called without holding the lock of the server, so they can call methods of the server.
+func (s *Server) OnResponse(fn func(r *Request, res *Response)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onResponse = append(s.onResponse, fn)
+}
+
+// DumpRequests writes requests received by router to w as indented JSON.
+func (s *Server) DumpRequests(w io.Writer) error {
+	type dump struct {
+		Service string      `json:"service"`
+		Method  string      `json:"method"`
+		Headers metadata.MD `json:"headers"`
+		Message Message     `json:"message"`
+	}
+	ds := []dump{}
+	for _, r := range s.Requests() {
+		ds = append(ds, dump{Service: r.Service, Method: r.Method, Headers: r.Headers, Message: r.Message})
+	}
+	b, err := json.MarshalIndent(ds, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// callOnRequest calls OnRequest callbacks with copies of rs.
+func (s *Server) callOnRequest(rs ...*Request) {
+	s.mu.RLock()
+	fns := s.onRequest
+	s.mu.RUnlock()
+	for _, r := range rs {
+		for _, fn := range fns {
+			fn(r.clone())
+		}
+	}
+}
+
+// callOnResponse calls OnResponse callbacks with a copy of r.
+func (s *Server) callOnResponse(r *Request, res *Response) {
+	s.mu.RLock()
+	fns := s.onResponse
+	s.mu.RUnlock()
+	for _, fn := range fns {
+		fn(r.clone(), res)
+	}
+}
+
+// noMatch calls OnResponse callbacks with the status set by UnmatchedStatus and returns it.
+func (s *Server) noMatch(r *Request, md protoreflect.MethodDescriptor) error {
+	err := s.unmatchedError(md)
+	res := NewResponse()
+	res.Status = status.Convert(err)
+	s.callOnResponse(r, res)
+	return err
+}
+
 // UnmatchedRequests returns []*grpcstub.Request received but not matched by router.
 func (s *Server) UnmatchedRequests() []*Request {
 	s.mu.RLock()
@@ -484,15 +2130,139 @@ func (s *Server) UnmatchedRequests() []*Request {
 	return s.unmatchedRequests
 }
 
+// AssertNoUnmatchedRequests reports an error for each request received but not matched by router.
+func (s *Server) AssertNoUnmatchedRequests(t TB) {
+	t.Helper()
+	for _, r := range s.UnmatchedRequests() {
+		t.Errorf("unmatched request: %s", r)
+	}
+}
+
+// RequestOrder returns `service/method` of requests received by router in the order received.
+// A streaming call has an entry for each request message.
+func (s *Server) RequestOrder() []string {
+	order := []string{}
+	for _, r := range s.Requests() {
+		order = append(order, fmt.Sprintf("%s/%s", r.Service, r.Method))
+	}
+	return order
+}
+
+// AssertCalledInOrder reports an error if requests received by router do not contain steps in order.
+// The steps need not be contiguous. Each step is a method in the same format as Method ( e.g. "GetFeature" or "routeguide.RouteGuide/GetFeature" ).
+func (s *Server) AssertCalledInOrder(t TB, steps ...string) {
+	t.Helper()
+	i := 0
+	for _, r := range s.Requests() {
+		if i == len(steps) {
+			break
+		}
+		if methodMatchFunc(steps[i])(r, nil) {
+			i++
+		}
+	}
+	if i < len(steps) {
+		t.Errorf("requests are not called in order: step %q of %v is not found in %v", steps[i], steps, s.RequestOrder())
+	}
+}
+
+// AssertExpectations reports an error for each expectation of matchers ( e.g. AssertExactCalls ) which is not met.
+func (s *Server) AssertExpectations(t TB) {
+	t.Helper()
+	s.mu.Lock()
+	s.expectationsAsserted = true
+	matchers := s.matchers
+	s.mu.Unlock()
+	for _, m := range matchers {
+		for _, msg := range m.unmetExpectations() {
+			t.Errorf("%s: %s", m, msg)
+		}
+	}
+}
+
 // ClearMatchers clear matchers.
 func (s *Server) ClearMatchers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.matchers = nil
 }
 
 // ClearRequests clear requests.
 func (s *Server) ClearRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.unmatchedRequests = nil
+}
+
+// ResetRequests clear requests recorded by router and reset all matchers using (*matcher).ResetRequests.
+// Use ClearRequests to clear only the requests recorded by router.
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.requests = nil
 	s.unmatchedRequests = nil
+	for _, m := range s.matchers {
+		m.ResetRequests()
+	}
+}
+
+// SentHeaders returns []metadata.MD of response headers sent by matcher.
+func (m *matcher) SentHeaders() []metadata.MD {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sentHeaders
+}
+
+// SentTrailers returns []metadata.MD of response trailers sent by matcher.
+func (m *matcher) SentTrailers() []metadata.MD {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sentTrailers
+}
+
+// Responses returns []*grpcstub.Response computed by the handlers of matcher.
+// For server streaming, the response of a call contains all messages sent in the call.
+func (m *matcher) Responses() []*Response {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.responses
+}
+
+func (m *matcher) recordResponse(res *Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses = append(m.responses, res)
+}
+
+// recordCall records requests of the call counted by matchRequest.
+func (m *matcher) recordCall(call int, rs ...*Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range rs {
+		r.call = call
+		r.matcher = m
+	}
+	m.requests = append(m.requests, cloneRequests(rs)...)
+}
+
+func (m *matcher) recordSent(headers, trailers metadata.MD) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sentHeaders = append(m.sentHeaders, headers.Copy())
+	m.sentTrailers = append(m.sentTrailers, trailers.Copy())
+}
+
+// ResetRequests clear requests, responses and the sent headers and trailers recorded by matcher, and reset the count of calls.
+// Times, ResponseSequence and expectations ( e.g. AssertExactCalls ) count calls from zero again.
+func (m *matcher) ResetRequests() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = nil
+	m.responses = nil
+	m.sentHeaders = nil
+	m.sentTrailers = nil
+	m.calls = 0
 }
 
 // Requests returns []*grpcstub.Request received by matcher.
@@ -511,14 +2281,27 @@ func (s *Server) registerServer() {
 	if !s.healthCheck {
 		return
 	}
+	if s.healthSrv != nil {
+		// Keep the serving statuses on restart.
+		healthpb.RegisterHealthServer(s.server, s.healthSrv)
+		return
+	}
 	healthSrv := health.NewServer()
+	s.healthSrv = healthSrv
 	healthpb.RegisterHealthServer(s.server, healthSrv)
 	healthSrv.SetServingStatus(HealthCheckService_DEFAULT, healthpb.HealthCheckResponse_SERVING)
 	go func() {
 		status := healthpb.HealthCheckResponse_SERVING
 		healthSrv.SetServingStatus(HealthCheckService_FLAPPING, status)
+		ticker := time.NewTicker(s.healthCheckFlapInterval)
+		defer ticker.Stop()
 		for {
-			switch s.status {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			switch s.getStatus() {
 			case status_start, status_starting:
 				if status == healthpb.HealthCheckResponse_SERVING {
 					status = healthpb.HealthCheckResponse_NOT_SERVING
@@ -527,7 +2310,6 @@ func (s *Server) registerServer() {
 				}
 				healthSrv.SetServingStatus(HealthCheckService_FLAPPING, status)
 			}
-			time.Sleep(100 * time.Millisecond)
 		}
 	}()
 }
@@ -577,68 +2359,61 @@ func (s *Server) createUnaryHandler(md protoreflect.MethodDescriptor) func(srv a
 		if err := dec(in); err != nil {
 			return nil, err
 		}
-		b, err := protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true, EmitUnpopulated: true}.Marshal(in)
-		if err != nil {
-			return nil, err
+		handler := func(ctx context.Context, req any) (any, error) {
+			return s.handleUnary(ctx, md, req.(proto.Message))
 		}
-		m := Message{}
-		if err := json.Unmarshal(b, &m); err != nil {
-			return nil, err
+		if interceptor == nil {
+			return handler(ctx, in)
 		}
-
-		r := newRequest(md, m)
-		h, ok := metadata.FromIncomingContext(ctx)
-		if ok {
-			r.Headers = h
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name()),
 		}
+		return interceptor(ctx, in, info, handler)
+	}
+}
 
-		var mes *dynamicpb.Message
-		for _, m := range s.matchers {
-			if !m.matchRequest(r) {
-				continue
-			}
-			s.mu.Lock()
-			s.requests = append(s.requests, r)
-			s.mu.Unlock()
-			m.mu.Lock()
-			m.requests = append(m.requests, r)
-			m.mu.Unlock()
-			res := m.handler(r, md)
-			for k, v := range res.Headers {
-				for _, vv := range v {
-					if err := grpc.SetHeader(ctx, metadata.Pairs(k, vv)); err != nil {
-						return nil, err
-					}
-				}
-			}
-			for k, v := range res.Trailers {
-				for _, vv := range v {
-					if err := grpc.SetTrailer(ctx, metadata.Pairs(k, vv)); err != nil {
-						return nil, err
-					}
-				}
-			}
-			if res.Status != nil && res.Status.Err() != nil {
-				return nil, res.Status.Err()
-			}
-			mes = dynamicpb.NewMessage(md.Output())
-			if len(res.Messages) > 0 {
-				b, err := json.Marshal(res.Messages[0])
-				if err != nil {
-					return nil, err
-				}
-				if err := (protojson.UnmarshalOptions{}).Unmarshal(b, mes); err != nil {
-					return nil, err
-				}
-			}
-			return mes, nil
-		}
+func (s *Server) handleUnary(ctx context.Context, md protoreflect.MethodDescriptor, in proto.Message) (any, error) {
+	r, err := s.newRequestFromMessage(ctx, md, in)
+	if err != nil {
+		return nil, err
+	}
+	s.callOnRequest(r)
 
+	for _, m := range s.sortedMatchers() {
+		call, ok := m.matchRequest(md, r)
+		if !ok {
+			continue
+		}
+		m.recordCall(call, r)
 		s.mu.Lock()
-		s.unmatchedRequests = append(s.unmatchedRequests, r)
+		s.requests = append(s.requests, r.clone())
 		s.mu.Unlock()
-		return mes, status.Error(codes.NotFound, codes.NotFound.String())
+		if err := m.setSendCompressor(ctx, md); err != nil {
+			return nil, err
+		}
+		res := m.validate(md, r)
+		if res == nil {
+			handler, _, _, _ := m.handlers()
+			res = s.callHandler(md, func() *Response { return handler(r, md) })
+		}
+		res = s.withDefaultMetadata(res)
+		m.recordResponse(res)
+		s.callOnResponse(r, res)
+		return s.sendUnaryResponse(ctx, md, m, res)
+	}
+
+	s.mu.Lock()
+	s.unmatchedRequests = append(s.unmatchedRequests, r.clone())
+	unmatched := s.unmatched
+	s.mu.Unlock()
+	if unmatched == nil {
+		return nil, s.noMatch(r, md)
 	}
+	res := s.callHandler(md, func() *Response { return unmatched(r, md) })
+	res = s.withDefaultMetadata(res)
+	s.callOnResponse(r, res)
+	return s.sendUnaryResponse(ctx, md, nil, res)
 }
 
 func (s *Server) createStreamHandler(md protoreflect.MethodDescriptor) func(srv any, stream grpc.ServerStream) error {
@@ -662,66 +2437,71 @@ func (s *Server) createServerStreamingHandler(md protoreflect.MethodDescriptor)
 		if err := stream.RecvMsg(in); err != nil {
 			return err
 		}
-		b, err := protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true, EmitUnpopulated: true}.Marshal(in)
+		r, err := s.newRequestFromMessage(stream.Context(), md, in)
 		if err != nil {
 			return err
 		}
-		m := Message{}
-		if err := json.Unmarshal(b, &m); err != nil {
-			return err
-		}
-		r := newRequest(md, m)
-		h, ok := metadata.FromIncomingContext(stream.Context())
-		if ok {
-			r.Headers = h
-		}
-		for _, m := range s.matchers {
-			if !m.matchRequest(r) {
+		s.callOnRequest(r)
+		for _, m := range s.sortedMatchers() {
+			call, ok := m.matchRequest(md, r)
+			if !ok {
 				continue
 			}
-			m.mu.Lock()
-			m.requests = append(m.requests, r)
-			m.mu.Unlock()
+			m.recordCall(call, r)
 			s.mu.Lock()
-			s.requests = append(s.requests, r)
+			s.requests = append(s.requests, r.clone())
 			s.mu.Unlock()
-			res := m.handler(r, md)
-			for k, v := range res.Headers {
-				for _, vv := range v {
-					if err := stream.SendHeader(metadata.Pairs(k, vv)); err != nil {
-						return err
-					}
-				}
-			}
-			for k, v := range res.Trailers {
-				for _, vv := range v {
-					stream.SetTrailer(metadata.Pairs(k, vv))
-				}
-			}
-			if res.Status != nil && res.Status.Err() != nil {
-				return res.Status.Err()
-			}
-			if len(res.Messages) > 0 {
-				for _, resm := range res.Messages {
-					mes := dynamicpb.NewMessage(md.Output())
-					b, err := json.Marshal(resm)
-					if err != nil {
-						return err
-					}
-					if err := (protojson.UnmarshalOptions{}).Unmarshal(b, mes); err != nil {
-						return err
-					}
-					if err := stream.SendMsg(mes); err != nil {
-						return err
-					}
+			if err := m.setSendCompressor(stream.Context(), md); err != nil {
+				return err
+			}
+			if res := m.validate(md, r); res != nil {
+				m.recordResponse(res)
+				s.callOnResponse(r, res)
+				return res.Status.Err()
+			}
+			if n := m.responseMaxInFlight(); n > 0 {
+				var release func()
+				stream, release = s.limitInFlight(stream, n)
+				defer release()
+			}
+			handler, serverStreamHandler, _, _ := m.handlers()
+			if serverStreamHandler != nil {
+				ss := &serverStream{s: s, stream: stream, md: md, res: s.withDefaultMetadata(NewResponse())}
+				if err := stream.SetHeader(ss.res.Headers); err != nil {
+					return err
+				}
+				stream.SetTrailer(ss.res.Trailers)
+				m.recordSent(ss.res.Headers, ss.res.Trailers)
+				err := s.callServerStreamHandler(md, func() error { return serverStreamHandler(r, ss) })
+				if err != nil {
+					ss.res.Status = status.Convert(err)
 				}
+				m.recordResponse(ss.res)
+				s.callOnResponse(r, ss.res)
+				return err
 			}
-			return nil
+			res := s.callHandler(md, func() *Response { return handler(r, md) })
+			res = s.withDefaultMetadata(res)
+			m.recordResponse(res)
+			s.callOnResponse(r, res)
+			headerSent := false
+			return s.sendStreamResponse(stream, md, m, res, &headerSent, m.responseInterval())
 		}
 		s.mu.Lock()
-		s.unmatchedRequests = append(s.unmatchedRequests, r)
+		s.unmatchedRequests = append(s.unmatchedRequests, r.clone())
+		unmatched := s.unmatched
 		s.mu.Unlock()
-		return status.Error(codes.NotFound, codes.NotFound.String())
+		if unmatched == nil {
+			if s.streamNoMatchKeepOpen {
+				return waitStreamDone(stream)
+			}
+			return s.noMatch(r, md)
+		}
+		res := s.callHandler(md, func() *Response { return unmatched(r, md) })
+		res = s.withDefaultMetadata(res)
+		s.callOnResponse(r, res)
+		headerSent := false
+		return s.sendStreamResponse(stream, md, nil, res, &headerSent, 0)
 	}
 }
 
@@ -731,76 +2511,67 @@ func (s *Server) createClientStreamingHandler(md protoreflect.MethodDescriptor)
 		for {
 			in := dynamicpb.NewMessage(md.Input())
 			err := stream.RecvMsg(in)
-			if err == nil {
-				b, err := protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true, EmitUnpopulated: true}.Marshal(in)
-				if err != nil {
-					return err
-				}
-				m := Message{}
-				if err := json.Unmarshal(b, &m); err != nil {
-					return err
-				}
-				r := newRequest(md, m)
-				h, ok := metadata.FromIncomingContext(stream.Context())
-				if ok {
-					r.Headers = h
-				}
-				rs = append(rs, r)
-				continue
+			if err == io.EOF {
+				break
 			}
-
-			if err != io.EOF {
+			if err != nil {
 				s.mu.Lock()
-				s.unmatchedRequests = append(s.unmatchedRequests, rs...)
+				s.unmatchedRequests = append(s.unmatchedRequests, cloneRequests(rs)...)
 				s.mu.Unlock()
 				return err
 			}
+			r, err := s.newRequestFromMessage(stream.Context(), md, in)
+			if err != nil {
+				return err
+			}
+			s.callOnRequest(r)
+			rs = append(rs, r)
+		}
 
-			var mes *dynamicpb.Message
-			for _, m := range s.matchers {
-				if !m.matchRequest(rs...) {
-					continue
-				}
-				s.mu.Lock()
-				s.requests = append(s.requests, rs...)
-				s.mu.Unlock()
-				m.mu.Lock()
-				m.requests = append(m.requests, rs...)
-				m.mu.Unlock()
-				last := rs[len(rs)-1]
-				res := m.handler(last, md)
-				if res.Status != nil && res.Status.Err() != nil {
-					return res.Status.Err()
-				}
-				mes = dynamicpb.NewMessage(md.Output())
-				if len(res.Messages) > 0 {
-					b, err := json.Marshal(res.Messages[0])
-					if err != nil {
-						return err
-					}
-					if err := (protojson.UnmarshalOptions{}).Unmarshal(b, mes); err != nil {
-						return err
-					}
-				}
-				for k, v := range res.Headers {
-					for _, vv := range v {
-						if err := stream.SendHeader(metadata.Pairs(k, vv)); err != nil {
-							return err
-						}
-					}
-				}
-				for k, v := range res.Trailers {
-					for _, vv := range v {
-						stream.SetTrailer((metadata.Pairs(k, vv)))
-					}
-				}
-				return stream.SendMsg(mes)
+		// Match and handle an empty request when the client sends no messages.
+		last := newRequest(stream.Context(), md, Message{})
+		match := []*Request{last}
+		if len(rs) > 0 {
+			last = rs[len(rs)-1]
+			match = rs
+		}
+		for _, m := range s.sortedMatchers() {
+			call, ok := m.matchRequest(md, match...)
+			if !ok {
+				continue
 			}
+			m.recordCall(call, rs...)
 			s.mu.Lock()
-			s.unmatchedRequests = append(s.unmatchedRequests, rs...)
+			s.requests = append(s.requests, cloneRequests(rs)...)
 			s.mu.Unlock()
-			return status.Error(codes.NotFound, codes.NotFound.String())
+			if err := m.setSendCompressor(stream.Context(), md); err != nil {
+				return err
+			}
+			handler, _, clientStreamHandler, _ := m.handlers()
+			res := m.validate(md, match...)
+			switch {
+			case res != nil:
+			case clientStreamHandler != nil:
+				res = s.callHandler(md, func() *Response { return clientStreamHandler(rs) })
+			default:
+				res = s.callHandler(md, func() *Response { return handler(last, md) })
+			}
+			res = s.withDefaultMetadata(res)
+			m.recordResponse(res)
+			s.callOnResponse(last, res)
+			return s.sendClientStreamingResponse(stream, md, m, res)
+		}
+		s.mu.Lock()
+		s.unmatchedRequests = append(s.unmatchedRequests, cloneRequests(rs)...)
+		unmatched := s.unmatched
+		s.mu.Unlock()
+		if unmatched == nil {
+			return s.noMatch(last, md)
 		}
+		res := s.callHandler(md, func() *Response { return unmatched(last, md) })
+		res = s.withDefaultMetadata(res)
+		s.callOnResponse(last, res)
+		return s.sendClientStreamingResponse(stream, md, nil, res)
 	}
 }
 
@@ -817,103 +2588,554 @@ func (s *Server) createBidiStreamingHandler(md protoreflect.MethodDescriptor) fu
 			if err != nil {
 				return err
 			}
-			b, err := protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true, EmitUnpopulated: true}.Marshal(in)
+			r, err := s.newRequestFromMessage(stream.Context(), md, in)
 			if err != nil {
 				return err
 			}
-			m := Message{}
-			if err := json.Unmarshal(b, &m); err != nil {
-				return err
-			}
-			r := newRequest(md, m)
-			h, ok := metadata.FromIncomingContext(stream.Context())
-			if ok {
-				r.Headers = h
-			}
-			for _, m := range s.matchers {
-				if !m.matchRequest(r) {
+			s.callOnRequest(r)
+			for _, m := range s.sortedMatchers() {
+				call, ok := m.matchRequest(md, r)
+				if !ok {
 					continue
 				}
+				m.recordCall(call, r)
 				s.mu.Lock()
-				s.requests = append(s.requests, r)
+				s.requests = append(s.requests, r.clone())
 				s.mu.Unlock()
-				m.mu.Lock()
-				m.requests = append(m.requests, r)
-				m.mu.Unlock()
-				res := m.handler(r, md)
 				if !headerSent {
-					for k, v := range res.Headers {
-						for _, vv := range v {
-							if err := stream.SendHeader(metadata.Pairs(k, vv)); err != nil {
-								return err
-							}
-							headerSent = true
-						}
+					// The compressor can be set only before the headers are sent.
+					if err := m.setSendCompressor(stream.Context(), md); err != nil {
+						return err
 					}
 				}
-				for k, v := range res.Trailers {
-					for _, vv := range v {
-						stream.SetTrailer(metadata.Pairs(k, vv))
-					}
+				if _, _, _, bidiStreamHandler := m.handlers(); bidiStreamHandler != nil {
+					return s.handleBidiStream(stream, md, m, r, headerSent, bidiStreamHandler)
 				}
-				if res.Status != nil && res.Status.Err() != nil {
-					return res.Status.Err()
+				res := m.validate(md, r)
+				if res == nil {
+					handler, _, _, _ := m.handlers()
+					res = s.callHandler(md, func() *Response { return handler(r, md) })
 				}
-				if len(res.Messages) > 0 {
-					for _, resm := range res.Messages {
-						mes := dynamicpb.NewMessage(md.Output())
-						b, err := json.Marshal(resm)
-						if err != nil {
-							return err
-						}
-						if err := (protojson.UnmarshalOptions{}).Unmarshal(b, mes); err != nil {
-							return err
-						}
-						if err := stream.SendMsg(mes); err != nil {
-							return err
-						}
-					}
+				res = s.withDefaultMetadata(res)
+				m.recordResponse(res)
+				s.callOnResponse(r, res)
+				if err := s.sendStreamResponse(stream, md, m, res, &headerSent, m.responseInterval()); err != nil {
+					return err
 				}
 				continue L
 			}
 			s.mu.Lock()
-			s.unmatchedRequests = append(s.unmatchedRequests, r)
+			s.unmatchedRequests = append(s.unmatchedRequests, r.clone())
+			unmatched := s.unmatched
 			s.mu.Unlock()
-			return status.Error(codes.NotFound, codes.NotFound.String())
+			if unmatched == nil {
+				if s.streamNoMatchKeepOpen {
+					return waitStreamDone(stream)
+				}
+				return s.noMatch(r, md)
+			}
+			res := s.callHandler(md, func() *Response { return unmatched(r, md) })
+			res = s.withDefaultMetadata(res)
+			s.callOnResponse(r, res)
+			if err := s.sendStreamResponse(stream, md, nil, res, &headerSent, 0); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleBidiStream passes the stream to the handler set by BidiHandler.
+func (s *Server) handleBidiStream(stream grpc.ServerStream, md protoreflect.MethodDescriptor, m *matcher, first *Request, headerSent bool, fn bidiStreamHandlerFunc) error {
+	bs := &bidiStream{
+		serverStream: serverStream{s: s, stream: stream, md: md, res: s.withDefaultMetadata(NewResponse())},
+		m:            m,
+		call:         first.call,
+		first:        first,
+	}
+	if res := m.validate(md, first); res != nil {
+		m.recordResponse(res)
+		s.callOnResponse(first, res)
+		return res.Status.Err()
+	}
+	sent := metadata.MD{}
+	if !headerSent {
+		// Headers can be sent only once per stream.
+		if err := stream.SetHeader(bs.res.Headers); err != nil {
+			return err
+		}
+		sent = bs.res.Headers
+	}
+	stream.SetTrailer(bs.res.Trailers)
+	m.recordSent(sent, bs.res.Trailers)
+	err := s.callServerStreamHandler(md, func() error { return fn(bs) })
+	if err != nil {
+		bs.res.Status = status.Convert(err)
+	}
+	m.recordResponse(bs.res)
+	s.callOnResponse(first, bs.res)
+	return err
+}
+
+// callHandler calls fn which calls the handler, and converts a panic in the handler into the response with Internal status.
+func (s *Server) callHandler(md protoreflect.MethodDescriptor, fn func() *Response) (res *Response) {
+	defer func() {
+		if p := recover(); p != nil {
+			res = NewResponse()
+			res.Status = s.handlerPanicked(md, p)
+		}
+	}()
+	return fn()
+}
+
+// callServerStreamHandler calls fn which calls the server stream handler, and converts a panic in the handler into Internal status.
+func (s *Server) callServerStreamHandler(md protoreflect.MethodDescriptor, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = s.handlerPanicked(md, p).Err()
+		}
+	}()
+	return fn()
+}
+
+// handlerPanicked reports the panic p in the handler as the test error and returns Internal status carrying p.
+func (s *Server) handlerPanicked(md protoreflect.MethodDescriptor, p any) *status.Status {
+	service, method := splitMethodFullName(md.FullName())
+	s.t.Errorf("handler for %s/%s panicked: %v", service, method, p)
+	return status.Newf(codes.Internal, "%s: handler for %s/%s panicked: %v", codes.Internal.String(), service, method, p)
+}
+
+// sendUnaryResponse sends res of the call, and records the sent headers and trailers to m if m is not nil.
+func (s *Server) sendUnaryResponse(ctx context.Context, md protoreflect.MethodDescriptor, m *matcher, res *Response) (*dynamicpb.Message, error) {
+	for k, v := range res.Headers {
+		for _, vv := range v {
+			if err := grpc.SetHeader(ctx, metadata.Pairs(k, vv)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for k, v := range res.Trailers {
+		for _, vv := range v {
+			if err := grpc.SetTrailer(ctx, metadata.Pairs(k, vv)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m != nil {
+		m.recordSent(res.Headers, res.Trailers)
+	}
+	if res.Status != nil && res.Status.Err() != nil {
+		return nil, res.Status.Err()
+	}
+	mes := dynamicpb.NewMessage(md.Output())
+	if len(res.Messages) > 0 {
+		var err error
+		mes, err = s.newResponseMessage(md, res.Messages[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mes, nil
+}
+
+// sendStreamResponse sends res of the call, and records the sent headers and trailers to m if m is not nil.
+func (s *Server) sendStreamResponse(stream grpc.ServerStream, md protoreflect.MethodDescriptor, m *matcher, res *Response, headerSent *bool, interval time.Duration) error {
+	// Headers can be sent only once per stream, with all values at once.
+	sent := metadata.MD{}
+	if !*headerSent && len(res.Headers) > 0 {
+		if err := stream.SendHeader(res.Headers); err != nil {
+			return err
+		}
+		*headerSent = true
+		sent = res.Headers
+	}
+	stream.SetTrailer(res.Trailers)
+	if m != nil {
+		m.recordSent(sent, res.Trailers)
+	}
+	if len(res.Messages) > 0 {
+		// Headers are sent with the first message implicitly.
+		*headerSent = true
+	}
+	for i, resm := range res.Messages {
+		if i > 0 && interval > 0 {
+			if err := sleepStream(stream, interval); err != nil {
+				return err
+			}
+		}
+		mes, err := s.newResponseMessage(md, resm)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(mes); err != nil {
+			return err
+		}
+	}
+	// The status is returned after the messages are sent.
+	if res.Status != nil && res.Status.Err() != nil {
+		return res.Status.Err()
+	}
+	return nil
+}
+
+// sendClientStreamingResponse sends res of the call, and records the sent headers and trailers to m if m is not nil.
+func (s *Server) sendClientStreamingResponse(stream grpc.ServerStream, md protoreflect.MethodDescriptor, m *matcher, res *Response) error {
+	// Headers can be sent only once per stream.
+	if len(res.Headers) > 0 {
+		if err := stream.SetHeader(res.Headers); err != nil {
+			return err
+		}
+	}
+	stream.SetTrailer(res.Trailers)
+	if m != nil {
+		m.recordSent(res.Headers, res.Trailers)
+	}
+	if res.Status != nil && res.Status.Err() != nil {
+		return res.Status.Err()
+	}
+	mes := dynamicpb.NewMessage(md.Output())
+	if len(res.Messages) > 0 {
+		var err error
+		mes, err = s.newResponseMessage(md, res.Messages[0])
+		if err != nil {
+			return err
+		}
+	}
+	return stream.SendMsg(mes)
+}
+
+// newResponseMessage converts the response message to the output message of the method.
+// If the conversion fails (e.g. the message has an unknown field), it also reports the error to TB.
+func (s *Server) newResponseMessage(md protoreflect.MethodDescriptor, m Message) (*dynamicpb.Message, error) {
+	mes := dynamicpb.NewMessage(md.Output())
+	b, err := json.Marshal(m)
+	if err != nil {
+		s.t.Errorf("failed to convert response of %s to %s: %v", md.FullName(), md.Output().FullName(), err)
+		return nil, err
+	}
+	if err := (protojson.UnmarshalOptions{}).Unmarshal(b, mes); err != nil {
+		s.t.Errorf("failed to convert response of %s to %s: %v", md.FullName(), md.Output().FullName(), err)
+		return nil, err
+	}
+	return mes, nil
+}
+
+// sleepStream waits for d or until the stream is done.
+func sleepStream(stream grpc.ServerStream, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-stream.Context().Done():
+		return status.FromContextError(stream.Context().Err()).Err()
+	}
+}
+
+func waitStreamDone(stream grpc.ServerStream) error {
+	<-stream.Context().Done()
+	return status.FromContextError(stream.Context().Err()).Err()
+}
+
+func (s *Server) unmatchedError(md protoreflect.MethodDescriptor) error {
+	s.mu.RLock()
+	st := s.unmatchedStatus
+	s.mu.RUnlock()
+	code := codes.Unimplemented
+	if st != nil {
+		if st.Message() != "" {
+			return st.Err()
 		}
+		code = st.Code()
+	}
+	service, method := splitMethodFullName(md.FullName())
+	return status.Errorf(code, "%s: no matcher for %s/%s", code.String(), service, method)
+}
+
+// validate returns the response with the status of the first validation error, or nil if all requests are valid.
+func (m *matcher) validate(md protoreflect.MethodDescriptor, rs ...*Request) *Response {
+	m.mu.RLock()
+	validators := m.validators
+	m.mu.RUnlock()
+	for _, r := range rs {
+		for _, fn := range validators {
+			err := fn(r, md)
+			if err == nil {
+				continue
+			}
+			st, ok := status.FromError(err)
+			if !ok {
+				st = status.New(codes.InvalidArgument, err.Error())
+			}
+			res := NewResponse()
+			res.Status = st
+			return res
+		}
+	}
+	return nil
+}
+
+// setSendCompressor sets the compressor of responses of the call if set by Compress.
+func (m *matcher) setSendCompressor(ctx context.Context, md protoreflect.MethodDescriptor) error {
+	m.mu.RLock()
+	name := m.compressor
+	m.mu.RUnlock()
+	if name == "" {
+		return nil
+	}
+	if _, ok := grpc.ServerTransportStreamFromContext(ctx).(*jsonTransportStream); ok {
+		// Responses of JSONHandler are not compressed.
+		return nil
+	}
+	if err := grpc.SetSendCompressor(ctx, name); err != nil {
+		service, method := splitMethodFullName(md.FullName())
+		m.t.Errorf("failed to compress response of %s/%s: %v", service, method, err)
+		return status.Errorf(codes.Internal, "%s: %v", codes.Internal.String(), err)
+	}
+	return nil
+}
+
+// handlers returns the handlers of the matcher, which can be replaced while serving.
+func (m *matcher) handlers() (handlerFunc, serverStreamHandlerFunc, clientStreamHandlerFunc, bidiStreamHandlerFunc) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.handler, m.serverStreamHandler, m.clientStreamHandler, m.bidiStreamHandler
+}
+
+func (m *matcher) responseInterval() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.interval
+}
+
+func (m *matcher) responseMaxInFlight() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxInFlight
+}
+
+// sortedMatchers returns matchers sorted by descending priority.
+func (s *Server) sortedMatchers() []*matcher {
+	s.mu.RLock()
+	matchers := make([]*matcher, len(s.matchers))
+	copy(matchers, s.matchers)
+	s.mu.RUnlock()
+	priorities := make(map[*matcher]int, len(matchers))
+	for _, m := range matchers {
+		m.mu.RLock()
+		priorities[m] = m.priority
+		m.mu.RUnlock()
 	}
+	sort.SliceStable(matchers, func(i, j int) bool {
+		return priorities[matchers[i]] > priorities[matchers[j]]
+	})
+	return matchers
 }
 
-func (m *matcher) matchRequest(rs ...*Request) bool {
+// matchRequest reports whether rs match the matcher, and returns the number of the call counted by the match.
+func (m *matcher) matchRequest(md protoreflect.MethodDescriptor, rs ...*Request) (int, bool) {
+	m.mu.RLock()
+	matchFuncs := m.matchFuncs
+	m.mu.RUnlock()
 	for _, r := range rs {
-		for _, fn := range m.matchFuncs {
-			if !fn(r) {
-				return false
+		for _, fn := range matchFuncs {
+			if !fn(r, md) {
+				return 0, false
+			}
+		}
+	}
+	return m.claim()
+}
+
+// claim counts the call and returns its number if the matcher can still match.
+// The call is counted at the match so that concurrent calls cannot exceed the limit set by Times.
+// A stream is counted as one call regardless of the number of messages received by BidiHandler.
+func (m *matcher) claim() (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limit > 0 && m.calls >= m.limit {
+		return 0, false
+	}
+	m.calls++
+	return m.calls, true
+}
+
+// fieldKey returns the key of the scalar value v of a request field or a key given to ResponseTable and ResponseByField.
+// Integers are formatted without converting to float64, so that 64-bit integers above 2^53 do not collide.
+// It returns false if v is not scalar ( e.g. message and list ).
+func fieldKey(v any) (string, bool) {
+	switch vv := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return vv, true
+	case bool:
+		return strconv.FormatBool(vv), true
+	case float64:
+		return strconv.FormatFloat(vv, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(vv), 'f', -1, 32), true
+	case int:
+		return strconv.FormatInt(int64(vv), 10), true
+	case int8:
+		return strconv.FormatInt(int64(vv), 10), true
+	case int16:
+		return strconv.FormatInt(int64(vv), 10), true
+	case int32:
+		return strconv.FormatInt(int64(vv), 10), true
+	case int64:
+		return strconv.FormatInt(vv, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(vv), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(vv), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(vv), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(vv), 10), true
+	case uint64:
+		return strconv.FormatUint(vv, 10), true
+	case json.Number:
+		if i, err := vv.Int64(); err == nil {
+			return strconv.FormatInt(i, 10), true
+		}
+		if f, err := vv.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64), true
+		}
+		return vv.String(), true
+	default:
+		return "", false
+	}
+}
+
+func requestMatchFunc(fn func(r *Request) bool) matchFunc {
+	return func(r *Request, _ protoreflect.MethodDescriptor) bool {
+		return fn(r)
+	}
+}
+
+// enumMatchFunc returns matchFunc which matches requests whose enum field at path has value.
+// The value is resolved to the number per request using the descriptor of the field in md.Input(), and requests whose message does not have the enum field at path do not match.
+// The path and the value are checked against request messages of all methods of s once, because the method is not known until the request comes.
+func enumMatchFunc(s *Server, path, value string) matchFunc {
+	s.t.Helper()
+	s.checkEnum(path, value)
+	return func(r *Request, md protoreflect.MethodDescriptor) bool {
+		ed := enumDescriptorByPath(md.Input(), path)
+		if ed == nil {
+			return false
+		}
+		want, ok := enumNumber(ed, value)
+		if !ok {
+			return false
+		}
+		v, ok := r.Message.lookup(path)
+		if !ok {
+			return false
+		}
+		switch vv := v.(type) {
+		case float64:
+			return protoreflect.EnumNumber(vv) == want
+		case string:
+			// Enum values are names when RequestMarshalOptions without UseEnumNumbers is set.
+			ev := ed.Values().ByNumber(want)
+			return ev != nil && string(ev.Name()) == vv
+		default:
+			return false
+		}
+	}
+}
+
+// checkEnum reports an error if no request message has the enum field at path which has value.
+func (s *Server) checkEnum(path, value string) {
+	s.t.Helper()
+	var found protoreflect.EnumDescriptor
+	for _, sd := range s.Services() {
+		for i := 0; i < sd.Methods().Len(); i++ {
+			ed := enumDescriptorByPath(sd.Methods().Get(i).Input(), path)
+			if ed == nil {
+				continue
+			}
+			if _, ok := enumNumber(ed, value); ok {
+				return
+			}
+			found = ed
+		}
+	}
+	if found == nil {
+		s.t.Errorf("%s is not enum field of any request message", path)
+		return
+	}
+	s.t.Errorf("%s is not value of %s", value, found.FullName())
+}
+
+// enumNumber returns the number of value which is either the name or the number of the enum value.
+func enumNumber(ed protoreflect.EnumDescriptor, value string) (protoreflect.EnumNumber, bool) {
+	if ev := ed.Values().ByName(protoreflect.Name(value)); ev != nil {
+		return ev.Number(), true
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return protoreflect.EnumNumber(n), true
+}
+
+// enumDescriptorByPath returns the enum descriptor of the field at the dot-separated path of the message.
+// Segments following repeated or map fields are treated as the index or the key.
+func enumDescriptorByPath(md protoreflect.MessageDescriptor, path string) protoreflect.EnumDescriptor {
+	var fd protoreflect.FieldDescriptor
+	skip := false
+	for _, k := range strings.Split(path, ".") {
+		if skip {
+			skip = false
+			continue
+		}
+		if fd != nil {
+			md = fd.Message()
+			if md == nil {
+				return nil
 			}
 		}
+		fd = md.Fields().ByName(protoreflect.Name(k))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(k)
+		}
+		if fd == nil {
+			return nil
+		}
+		switch {
+		case fd.IsMap():
+			fd = fd.MapValue()
+			skip = true
+		case fd.IsList():
+			skip = true
+		}
 	}
-	return true
+	if fd == nil || skip {
+		return nil
+	}
+	return fd.Enum()
 }
 
 func serviceMatchFunc(service string) matchFunc {
-	return func(r *Request) bool {
+	return func(r *Request, _ protoreflect.MethodDescriptor) bool {
 		return r.Service == strings.TrimPrefix(service, "/")
 	}
 }
 
 func methodMatchFunc(method string) matchFunc {
-	return func(r *Request) bool {
+	return func(r *Request, _ protoreflect.MethodDescriptor) bool {
 		if !strings.Contains(method, "/") {
 			return r.Method == method
 		}
-		splitted := strings.Split(strings.TrimPrefix(method, "/"), "/")
-		s := strings.Join(splitted[:len(splitted)-1], "/")
-		m := splitted[len(splitted)-1]
-		return r.Service == s && r.Method == m
+		// Accept both `package.Service/Method` and the full method name `/package.Service/Method`.
+		fullname := strings.TrimPrefix(method, "/")
+		i := strings.LastIndex(fullname, "/")
+		return r.Service == fullname[:i] && r.Method == fullname[i+1:]
 	}
 }
 
-func (s *Server) resolveProtos(ctx context.Context, importPaths, protos []string) error {
+func (s *Server) resolveProtos(ctx context.Context, importPaths, protos []string, compilerFuncs ...func(*protocompile.Compiler)) error {
 	importPaths, protos, err := resolvePaths(importPaths, protos...)
 	if err != nil {
 		return err
@@ -923,63 +3145,47 @@ func (s *Server) resolveProtos(ctx context.Context, importPaths, protos []string
 			ImportPaths: importPaths,
 		}),
 	}
+	for _, fn := range compilerFuncs {
+		fn(&comp)
+	}
 	fds, err := comp.Compile(ctx, protos...)
 	if err != nil {
 		return err
 	}
-	if err := registerFiles(fds); err != nil {
+	files, err := newFiles(fds)
+	if err != nil {
 		return err
 	}
 	s.fds = fds
+	s.files = files
 	return nil
 }
 
-func registerFiles(fds linker.Files) (err error) {
-	for _, fd := range fds {
-		// Skip registration of already registered descriptors
-		if _, err := protoregistry.GlobalFiles.FindFileByPath(fd.Path()); !errors.Is(protoregistry.NotFound, err) {
-			continue
+// newFiles returns *protoregistry.Files of the server which contains fds and their dependencies.
+// The files are not registered to protoregistry.GlobalFiles, so that servers with overlapping protos do not conflict.
+func newFiles(fds linker.Files) (*protoregistry.Files, error) {
+	files := &protoregistry.Files{}
+	var register func(fd protoreflect.FileDescriptor) error
+	register = func(fd protoreflect.FileDescriptor) error {
+		if fd.IsPlaceholder() {
+			return nil
 		}
-		// Skip registration of conflicted descriptors
-		conflict := false
-		rangeTopLevelDescriptors(fd, func(d protoreflect.Descriptor) {
-			if _, err := protoregistry.GlobalFiles.FindDescriptorByName(d.FullName()); err == nil {
-				conflict = true
-			}
-		})
-		if conflict {
-			continue
+		if _, err := files.FindFileByPath(fd.Path()); err == nil {
+			return nil
 		}
-
-		if err := protoregistry.GlobalFiles.RegisterFile(fd); err != nil {
-			return err
+		for i := 0; i < fd.Imports().Len(); i++ {
+			if err := register(fd.Imports().Get(i).FileDescriptor); err != nil {
+				return err
+			}
 		}
+		return files.RegisterFile(fd)
 	}
-	return nil
-}
-
-// copy from google.golang.org/protobuf/reflect/protoregistry
-func rangeTopLevelDescriptors(fd protoreflect.FileDescriptor, f func(protoreflect.Descriptor)) {
-	eds := fd.Enums()
-	for i := eds.Len() - 1; i >= 0; i-- {
-		f(eds.Get(i))
-		vds := eds.Get(i).Values()
-		for i := vds.Len() - 1; i >= 0; i-- {
-			f(vds.Get(i))
+	for _, fd := range fds {
+		if err := register(fd); err != nil {
+			return nil, err
 		}
 	}
-	mds := fd.Messages()
-	for i := mds.Len() - 1; i >= 0; i-- {
-		f(mds.Get(i))
-	}
-	xds := fd.Extensions()
-	for i := xds.Len() - 1; i >= 0; i-- {
-		f(xds.Get(i))
-	}
-	sds := fd.Services()
-	for i := sds.Len() - 1; i >= 0; i-- {
-		f(sds.Get(i))
-	}
+	return files, nil
 }
 
 func resolvePaths(importPaths []string, protos ...string) ([]string, []string, error) {
@@ -1003,14 +3209,23 @@ func resolvePaths(importPaths []string, protos ...string) ([]string, []string, e
 		if err != nil {
 			return nil, nil, err
 		}
+		// Resolve against the first import path containing the proto only, so that the same file is not compiled twice under different names.
+		resolved := false
 		for _, ip := range resolvedIPaths {
 			if strings.HasPrefix(abs, ip+sep) {
 				resolvedProtos = append(resolvedProtos, strings.TrimPrefix(abs, ip+sep))
+				resolved = true
+				break
 			}
 		}
+		if !resolved {
+			// The proto outside of import paths is resolved against its own directory.
+			resolvedIPaths = append(resolvedIPaths, filepath.Dir(abs))
+			resolvedProtos = append(resolvedProtos, filepath.Base(abs))
+		}
 	}
 	resolvedProtos = unique(resolvedProtos)
-	return resolvedIPaths, resolvedProtos, nil
+	return unique(resolvedIPaths), resolvedProtos, nil
 }
 
 func splitMethodFullName(mn protoreflect.FullName) (string, string) {
@@ -1,23 +1,50 @@
 package grpcstub
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/bufbuild/protocompile"
 	"github.com/google/go-cmp/cmp"
 	"github.com/jhump/protoreflect/v2/grpcreflect"
 	"github.com/k1LoW/grpcstub/testdata/hello"
 	"github.com/k1LoW/grpcstub/testdata/routeguide"
 	"github.com/tenntenn/golden"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionv1alphapb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -30,6 +57,47 @@ func TestAddr(t *testing.T) {
 	if !strings.HasPrefix(got, "127.0.0.1:") {
 		t.Errorf("got %v\nwant 127.0.0.1:*", got)
 	}
+	if got, want := ts.Host(), "127.0.0.1"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := net.JoinHostPort(ts.Host(), strconv.Itoa(ts.Port())), ts.Addr(); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestServicesAndMethods(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto", Proto("testdata/hello.proto"))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	var services []string
+	for _, sd := range ts.Services() {
+		services = append(services, string(sd.FullName()))
+	}
+	sort.Strings(services)
+	if want := []string{"hello.GrpcTestService", "routeguide.RouteGuide"}; !cmp.Equal(services, want) {
+		t.Errorf("got %v\nwant %v", services, want)
+	}
+
+	tests := []struct {
+		service string
+		want    []string
+	}{
+		{"routeguide.RouteGuide", []string{"GetFeature", "ListFeatures", "RecordRoute", "RouteChat"}},
+		{"/hello.GrpcTestService", []string{"Hello"}},
+		{"unknown.Service", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			var got []string
+			for _, md := range ts.Methods(tt.service) {
+				got = append(got, string(md.Name()))
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
 }
 
 func TestServerMatch(t *testing.T) {
@@ -80,6 +148,44 @@ func TestMatcherMatch(t *testing.T) {
 	}
 }
 
+func TestMatchWithDescriptor(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.MatchWithDescriptor(func(r *Request, md protoreflect.MethodDescriptor) bool {
+		return !md.IsStreamingClient() && !md.IsStreamingServer()
+	}).Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{
+		Latitude:  10,
+		Longitude: 13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	{
+		got := res.Name
+		if want := "hello"; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	{
+		got := status.Code(err)
+		if want := codes.Unimplemented; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+}
+
 func TestServerService(t *testing.T) {
 	ctx := context.Background()
 	ts := NewServer(t, "testdata/route_guide.proto")
@@ -173,6 +279,34 @@ func TestHeader(t *testing.T) {
 	}
 }
 
+func TestEchoHeader(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").EchoHeader("x-request-id").EchoTrailer("x-request-id").EchoHeader("missing").Header("size", "213").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", "abc")
+	var header, trailer metadata.MD
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header.Get("x-request-id"), []string{"abc"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := trailer.Get("x-request-id"), []string{"abc"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got := header.Get("missing"); got != nil {
+		t.Errorf("got %v\nwant nil", got)
+	}
+	if got, want := header.Get("size"), []string{"213"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
 func TestTrailer(t *testing.T) {
 	ctx := context.Background()
 	ts := NewServer(t, "testdata/route_guide.proto")
@@ -200,6 +334,70 @@ func TestTrailer(t *testing.T) {
 	}
 }
 
+func TestTrailersOnlyError(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	for _, method := range []string{"GetFeature", "ListFeatures", "RecordRoute", "RouteChat"} {
+		ts.Method(method).Trailer("reason", "quota").Status(status.New(codes.ResourceExhausted, "exhausted"))
+	}
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+
+	tests := []struct {
+		name string
+		call func(trailer *metadata.MD) error
+	}{
+		{"unary", func(trailer *metadata.MD) error {
+			_, err := client.GetFeature(ctx, &routeguide.Point{}, grpc.Trailer(trailer))
+			return err
+		}},
+		{"server streaming", func(trailer *metadata.MD) error {
+			stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			*trailer = stream.Trailer()
+			return err
+		}},
+		{"client streaming", func(trailer *metadata.MD) error {
+			stream, err := client.RecordRoute(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = stream.CloseAndRecv()
+			*trailer = stream.Trailer()
+			return err
+		}},
+		{"bidirectional streaming", func(trailer *metadata.MD) error {
+			stream, err := client.RouteChat(ctx)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(&routeguide.RouteNote{}); err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			*trailer = stream.Trailer()
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trailer metadata.MD
+			err := tt.call(&trailer)
+			if got, want := status.Code(err), codes.ResourceExhausted; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+			if got, want := trailer.Get("reason"), []string{"quota"}; !cmp.Equal(got, want) {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
 func TestResponseHeader(t *testing.T) {
 	ctx := context.Background()
 	ts := NewServer(t, "testdata/route_guide.proto")
@@ -449,6 +647,119 @@ func TestLoadProto(t *testing.T) {
 	}
 }
 
+func TestRequestMarshalOptions(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/hello.proto", RequestMarshalOptions(protojson.MarshalOptions{}), Int64AsNumber())
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("Hello").Response(map[string]any{"message": "hello"})
+	client := hello.NewGrpcTestServiceClient(ts.Conn())
+	if _, err := client.Hello(ctx, &hello.HelloRequest{Num: 35, RequestTime: timestamppb.New(time.Unix(1, 0))}); err != nil {
+		t.Fatal(err)
+	}
+	got := ts.Requests()[0].Message
+	want := Message{"num": int64(35), "requestTime": "1970-01-01T00:00:01Z"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestRequestMarshalOptionsStreaming(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto", RequestMarshalOptions(protojson.MarshalOptions{UseProtoNames: true}))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	ts.Method("ListFeatures").Response(map[string]any{"name": "hello"})
+	ts.Method("RecordRoute").Response(map[string]any{"point_count": 1})
+	ts.Method("RouteChat").Response(map[string]any{"message": "hello"})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+
+	if _, err := client.GetFeature(ctx, &routeguide.Point{Longitude: 1}); err != nil {
+		t.Fatal(err)
+	}
+	{
+		stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{Lo: &routeguide.Point{Longitude: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	{
+		stream, err := client.RecordRoute(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&routeguide.Point{Longitude: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.CloseAndRecv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	{
+		stream, err := client.RouteChat(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&routeguide.RouteNote{Message: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []Message{
+		{"longitude": float64(1)},
+		{"lo": map[string]any{"longitude": float64(1)}},
+		{"longitude": float64(1)},
+		{"message": "hi"},
+	}
+	var got []Message
+	for _, r := range ts.Requests() {
+		got = append(got, r.Message)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLoadProtos(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto",
+		Protos([]string{"testdata/hello.proto", "testdata/imports/svc"}),
+		ImportPath("testdata/imports/lib"),
+	)
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	client := grpcreflect.NewClientAuto(ctx, ts.ClientConn())
+	svcs, err := client.ListServices()
+	client.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"routeguide.RouteGuide", "hello.GrpcTestService", "item.ItemService"} {
+		found := false
+		for _, svc := range svcs {
+			if string(svc) == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("service not found: %s", want)
+		}
+	}
+}
+
 func TestTime(t *testing.T) {
 	now := time.Now()
 	tests := []struct {
@@ -550,6 +861,68 @@ func TestTLSServer(t *testing.T) {
 	}
 }
 
+func TestTLSConfigAndDialContext(t *testing.T) {
+	ctx := context.Background()
+	cacert, err := os.ReadFile("testdata/cacert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := os.ReadFile("testdata/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTLSServer(t, "testdata/route_guide.proto", cacert, cert, key)
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	if got := ts.CACert(); !bytes.Equal(got, cacert) {
+		t.Errorf("got %s\nwant %s", got, cacert)
+	}
+	tlsc := ts.TLSConfig()
+	if tlsc == nil {
+		t.Fatal("want tls config")
+	}
+	if got, want := len(tlsc.Certificates), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	tlsc.Certificates = nil
+	_ = ts.Conn()
+	if ts.tlsc.RootCAs != nil || ts.tlsc.InsecureSkipVerify {
+		t.Error("Conn should not mutate the tls config of the server")
+	}
+	if got, want := len(ts.tlsc.Certificates), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	conn, err := ts.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	client := routeguide.NewRouteGuideClient(conn)
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "hello"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+
+	insecureServer := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		insecureServer.Close()
+	})
+	if got := insecureServer.TLSConfig(); got != nil {
+		t.Errorf("got %v\nwant nil", got)
+	}
+}
+
 func TestHealthCheck(t *testing.T) {
 	tests := []struct {
 		enable  bool
@@ -589,21 +962,20 @@ func TestHealthCheck(t *testing.T) {
 
 func TestReflection(t *testing.T) {
 	tests := []struct {
-		disableReflection bool
-		wantErr           bool
+		opts    []Option
+		wantErr bool
 	}{
-		{false, false},
-		{true, true},
+		{nil, false},
+		{[]Option{DisableReflection()}, true},
+		{[]Option{Reflection(true)}, false},
+		{[]Option{Reflection(false)}, true},
+		{[]Option{DisableReflection(), Reflection(true)}, false},
 	}
 	proto := "testdata/route_guide.proto"
 	ctx := context.Background()
 	for i, tt := range tests {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
-			opts := []Option{}
-			if tt.disableReflection {
-				opts = append(opts, DisableReflection())
-			}
-			ts := NewServer(t, proto, opts...)
+			ts := NewServer(t, proto, tt.opts...)
 			t.Cleanup(func() {
 				ts.Close()
 			})
@@ -623,60 +995,2210 @@ func TestReflection(t *testing.T) {
 	}
 }
 
-func TestRequestStringer(t *testing.T) {
+func TestReflectionVersions(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	cc := ts.Conn()
 	tests := []struct {
-		r *Request
+		name   string
+		client *grpcreflect.Client
 	}{
-		{
-			&Request{
-				Service: "helloworld.Greeter",
-				Method:  "SayHello",
-				Message: map[string]any{"name": "alice"},
-				Headers: map[string][]string{"foo": {"bar", "barbar"}, "baz": {"qux"}},
-			},
-		},
-		{
-			&Request{
-				Service: "helloworld.Greeter",
-				Method:  "SayHello",
-			},
-		},
+		{"v1", grpcreflect.NewClientV1(ctx, reflectionpb.NewServerReflectionClient(cc))},
+		{"v1alpha", grpcreflect.NewClientV1Alpha(ctx, reflectionv1alphapb.NewServerReflectionClient(cc))},
 	}
-	for i, tt := range tests {
-		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
-			got := tt.r.String()
-			f := fmt.Sprintf("request_stringer_%d", i)
-			if os.Getenv("UPDATE_GOLDEN") != "" {
-				golden.Update(t, "testdata", f, got)
-				return
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, err := tt.client.ListServices()
+			tt.client.Reset()
+			if err != nil {
+				t.Fatal(err)
 			}
-			if diff := golden.Diff(t, "testdata", f, got); diff != "" {
-				t.Error(diff)
+			got := false
+			for _, s := range services {
+				if s == "routeguide.RouteGuide" {
+					got = true
+				}
+			}
+			if !got {
+				t.Errorf("got %v\nwant to contain %v", services, "routeguide.RouteGuide")
 			}
 		})
 	}
 }
 
-func TestResponseAny(t *testing.T) {
+func TestReflectionPerServerDescriptors(t *testing.T) {
 	ctx := context.Background()
-	ts := NewServer(t, "testdata/route_guide.proto")
-	t.Cleanup(func() {
-		ts.Close()
-	})
-	ts.Service("routeguide.RouteGuide").Method("GetFeature").Response(&routeguide.Feature{
-		Name: "hello",
-	})
-
-	client := routeguide.NewRouteGuideClient(ts.Conn())
-	res, err := client.GetFeature(ctx, &routeguide.Point{
-		Latitude:  10,
-		Longitude: 13,
-	})
-	if err != nil {
-		t.Fatal(err)
+	tests := []struct {
+		proto       string
+		wantMethods int
+	}{
+		{"testdata/route_guide.proto", 4},
+		{"testdata/route_guide.proto", 4},
+		{"testdata/overlap/route_guide.proto", 1},
 	}
-	got := res.Name
-	if want := "hello"; got != want {
+	servers := make([]*Server, len(tests))
+	for i, tt := range tests {
+		ts := NewServer(t, tt.proto)
+		t.Cleanup(func() {
+			ts.Close()
+		})
+		ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+		servers[i] = ts
+	}
+	// The servers are called concurrently to check that they do not share the descriptors.
+	methods := make([]int, len(tests))
+	names := make([]string, len(tests))
+	errs := make([]error, len(tests))
+	var wg sync.WaitGroup
+	for i := range tests {
+		i := i
+		ts := servers[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := grpcreflect.NewClientAuto(ctx, ts.Conn())
+			defer client.Reset()
+			fd, err := client.FileContainingSymbol("routeguide.RouteGuide")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			methods[i] = fd.Services().ByName("RouteGuide").Methods().Len()
+			res, err := routeguide.NewRouteGuideClient(ts.Conn()).GetFeature(ctx, &routeguide.Point{})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			names[i] = res.Name
+		}()
+	}
+	wg.Wait()
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			if errs[i] != nil {
+				t.Fatal(errs[i])
+			}
+			if got := methods[i]; got != tt.wantMethods {
+				t.Errorf("got %v\nwant %v", got, tt.wantMethods)
+			}
+			if got, want := names[i], "hello"; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHideHealthFromReflection(t *testing.T) {
+	tests := []struct {
+		hide       bool
+		wantHealth bool
+	}{
+		{false, true},
+		{true, false},
+	}
+	ctx := context.Background()
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			opts := []Option{EnableHealthCheck()}
+			if tt.hide {
+				opts = append(opts, HideHealthFromReflection())
+			}
+			ts := NewServer(t, "testdata/route_guide.proto", opts...)
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			client := grpcreflect.NewClientAuto(ctx, ts.ClientConn())
+			services, err := client.ListServices()
+			client.Reset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := false
+			for _, s := range services {
+				if s == "grpc.health.v1.Health" {
+					got = true
+				}
+			}
+			if got != tt.wantHealth {
+				t.Errorf("got %v\nwant %v", got, tt.wantHealth)
+			}
+			hc := healthpb.NewHealthClient(ts.ClientConn())
+			if _, err := hc.Check(ctx, &healthpb.HealthCheckRequest{Service: HealthCheckService_DEFAULT}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRequestsFor(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	ts.Method("ListFeatures").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		got  []*Request
+		want int
+	}{
+		{ts.RequestsForService("routeguide.RouteGuide"), 3},
+		{ts.RequestsForService("hello.GrpcTestService"), 0},
+		{ts.RequestsForMethod("routeguide.RouteGuide", "GetFeature"), 2},
+		{ts.RequestsForMethod("routeguide.RouteGuide", "ListFeatures"), 1},
+		{ts.RequestsForMethod("routeguide.RouteGuide", "RecordRoute"), 0},
+	}
+	for i, tt := range tests {
+		if got := len(tt.got); got != tt.want {
+			t.Errorf("%d: got %v\nwant %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestRequestStringer(t *testing.T) {
+	tests := []struct {
+		r *Request
+	}{
+		{
+			&Request{
+				Service: "helloworld.Greeter",
+				Method:  "SayHello",
+				Message: map[string]any{"name": "alice"},
+				Headers: map[string][]string{"foo": {"bar", "barbar"}, "baz": {"qux"}},
+			},
+		},
+		{
+			&Request{
+				Service: "helloworld.Greeter",
+				Method:  "SayHello",
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			got := tt.r.String()
+			f := fmt.Sprintf("request_stringer_%d", i)
+			if os.Getenv("UPDATE_GOLDEN") != "" {
+				golden.Update(t, "testdata", f, got)
+				return
+			}
+			if diff := golden.Diff(t, "testdata", f, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestResponseAny(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Service("routeguide.RouteGuide").Method("GetFeature").Response(&routeguide.Feature{
+		Name: "hello",
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{
+		Latitude:  10,
+		Longitude: 13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := res.Name
+	if want := "hello"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestTransportHeaders(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return strings.HasPrefix(r.Headers.Get("content-type")[0], "application/grpc")
+	}).Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	r := ts.Requests()[0]
+	for _, k := range []string{":authority", "content-type", "user-agent"} {
+		if got := r.Headers.Get(k); len(got) == 0 {
+			t.Errorf("header %s not found", k)
+		}
+	}
+	if got := r.Headers.Get("te"); len(got) != 0 {
+		t.Errorf("got %v\nwant empty", got)
+	}
+}
+
+func TestCloseClientConn(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	cc := ts.Conn()
+	ts.CloseClientConn()
+	if _, err := routeguide.NewRouteGuideClient(cc).GetFeature(ctx, &routeguide.Point{}); err == nil {
+		t.Error("want error")
+	}
+	if _, err := routeguide.NewRouteGuideClient(ts.Conn()).GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultipleConns(t *testing.T) {
+	ctx := context.Background()
+	cacert, err := os.ReadFile("testdata/cacert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := os.ReadFile("testdata/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTLSServer(t, "testdata/route_guide.proto", cacert, cert, key)
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	if ts.Conn() != ts.Conn() {
+		t.Error("want the shared conn")
+	}
+	conns := []*grpc.ClientConn{ts.Conn(), ts.NewConn(), ts.Conn(grpc.WithUserAgent("grpcstub"))}
+	if conns[0] == conns[1] || conns[0] == conns[2] || conns[1] == conns[2] {
+		t.Fatal("want different conns")
+	}
+	for _, cc := range conns {
+		if _, err := routeguide.NewRouteGuideClient(cc).GetFeature(ctx, &routeguide.Point{}); err != nil {
+			t.Error(err)
+		}
+	}
+	ts.Close()
+	for i, cc := range conns {
+		if got, want := cc.GetState(), connectivity.Shutdown; got != want {
+			t.Errorf("conns[%d]: got %v\nwant %v", i, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Compress("gzip").Response(map[string]any{"name": "hello"})
+	ts.Method("ListFeatures").Compress("gzip").Response(map[string]any{"name": "hello"}).Response(map[string]any{"name": "world"})
+	ts.Method("RecordRoute").Response(map[string]any{"point_count": 1})
+
+	sh := &compressionStatsHandler{}
+	client := routeguide.NewRouteGuideClient(ts.Conn(grpc.WithStatsHandler(sh)))
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "hello"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, res.Name)
+	}
+	if want := []string{"hello", "world"}; !cmp.Equal(names, want) {
+		t.Errorf("got %v\nwant %v", names, want)
+	}
+	cstream, err := client.RecordRoute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cstream.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := sh.compressions(), []string{"gzip", "gzip", ""}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestCompressNotRegistered(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	tb := &recordTB{}
+	m := ts.Method("GetFeature")
+	m.t = tb
+	m.Compress("unknown")
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+var _ stats.Handler = (*compressionStatsHandler)(nil)
+
+// compressionStatsHandler is stats.Handler which records the compression of the received headers.
+type compressionStatsHandler struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (h *compressionStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *compressionStatsHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if in, ok := s.(*stats.InHeader); ok && in.Client {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.got = append(h.got, in.Compression)
+	}
+}
+
+func (h *compressionStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *compressionStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+func (h *compressionStatsHandler) compressions() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.got
+}
+
+func TestMaxMsgSize(t *testing.T) {
+	ctx := context.Background()
+	const size = 8 * 1024 * 1024
+	ts := NewServer(t, "testdata/hello.proto", MaxRecvMsgSize(1024), MaxSendMsgSize(size))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	// The response is larger than the default max receive message size ( 4MB ) of clients.
+	ts.Method("Hello").Response(map[string]any{"message": strings.Repeat("a", size-1024)})
+	client := hello.NewGrpcTestServiceClient(ts.Conn())
+
+	tests := []struct {
+		name     string
+		req      string
+		wantCode codes.Code
+	}{
+		{"under the limit", strings.Repeat("a", 1000), codes.OK},
+		{"over the limit", strings.Repeat("a", 1024), codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.Hello(ctx, &hello.HelloRequest{Name: tt.req})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("got %v\nwant %v", got, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := len(res.Message), size-1024; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	ctx := context.Background()
+	sock := filepath.Join(t.TempDir(), "grpcstub.sock")
+	ts := NewServer(t, "testdata/route_guide.proto", UnixSocket(sock))
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	if got := ts.Addr(); got != sock {
+		t.Errorf("got %v\nwant %v", got, sock)
+	}
+	if got := ts.Host(); got != "" {
+		t.Errorf("got %v\nwant empty", got)
+	}
+	if got := ts.Port(); got != 0 {
+		t.Errorf("got %v\nwant %v", got, 0)
+	}
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello"; res.Name != want {
+		t.Errorf("got %v\nwant %v", res.Name, want)
+	}
+
+	ts.Close()
+	if _, err := os.Stat(sock); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket file is not removed: %v", err)
+	}
+}
+
+func TestResponseErrorf(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").ResponseErrorf(codes.NotFound, "feature %d not found", 3)
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+
+	_, err := client.GetFeature(ctx, &routeguide.Point{})
+	s, ok := status.FromError(err)
+	if !ok {
+		t.Fatal("want status.Status")
+	}
+	if want := codes.NotFound; s.Code() != want {
+		t.Errorf("got %v\nwant %v", s.Code(), want)
+	}
+	if want := "feature 3 not found"; s.Message() != want {
+		t.Errorf("got %v\nwant %v", s.Message(), want)
+	}
+}
+
+func TestResetRequests(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		calls int
+	}{
+		{1},
+		{3},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			ts.ResetRequests()
+			for j := 0; j < tt.calls; j++ {
+				if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := len(ts.Requests()); got != tt.calls {
+				t.Errorf("got %v\nwant %v", got, tt.calls)
+			}
+			if got := len(m.Requests()); got != tt.calls {
+				t.Errorf("got %v\nwant %v", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestMatcherResetRequests(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("GetFeature").Times(1).Header("hello", "header").ResponseSequence(Message{"name": "first"}, Message{"name": "second"})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	for i := 0; i < 2; i++ {
+		res, err := client.GetFeature(ctx, &routeguide.Point{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.Name, "first"; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := len(m.Requests()), 1; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := len(m.Responses()), 1; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := len(m.SentHeaders()), 1; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		m.ResetRequests()
+		if got, want := len(m.Requests()), 0; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := len(m.Responses()), 0; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := len(m.SentHeaders()), 0; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+}
+
+func TestServerOption(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu            sync.Mutex
+		unary, stream []string
+	)
+	ts := NewServer(t, "testdata/route_guide.proto", ServerOption(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			mu.Lock()
+			unary = append(unary, info.FullMethod)
+			mu.Unlock()
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			mu.Lock()
+			stream = append(stream, info.FullMethod)
+			mu.Unlock()
+			return handler(srv, ss)
+		}),
+	))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	ts.Method("ListFeatures").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello"; res.Name != want {
+		t.Errorf("got %v\nwant %v", res.Name, want)
+	}
+	s, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(unary, []string{"/routeguide.RouteGuide/GetFeature"}); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff(stream, []string{"/routeguide.RouteGuide/ListFeatures"}); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestRequestHeader(t *testing.T) {
+	r := &Request{Headers: metadata.Pairs("X-Request-Id", "a", "x-request-id", "b")}
+	tests := []struct {
+		key        string
+		wantHeader string
+		wantValues []string
+		wantHas    bool
+	}{
+		{"x-request-id", "a", []string{"a", "b"}, true},
+		{"X-REQUEST-ID", "a", []string{"a", "b"}, true},
+		{"missing", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := r.Header(tt.key); got != tt.wantHeader {
+				t.Errorf("got %v\nwant %v", got, tt.wantHeader)
+			}
+			if got := r.HeaderValues(tt.key); !cmp.Equal(got, tt.wantValues) {
+				t.Errorf("got %v\nwant %v", got, tt.wantValues)
+			}
+			if got := r.HasHeader(tt.key); got != tt.wantHas {
+				t.Errorf("got %v\nwant %v", got, tt.wantHas)
+			}
+		})
+	}
+}
+
+func TestRequestStruct(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/struct.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("Echo").Match(func(r *Request) bool {
+		st, ok := r.Struct("attrs.items.1")
+		return ok && st["name"] == "bob"
+	}).Handler(func(r *Request) *Response {
+		res := NewResponse()
+		st, _ := r.Struct("attrs.owner")
+		res.Messages = append(res.Messages, Message{"attrs": st})
+		return res
+	})
+
+	resolver := ts.fds.AsResolver()
+	inD, err := resolver.FindMessageByName("structtest.EchoRequest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outD, err := resolver.FindMessageByName("structtest.EchoResponse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := dynamicpb.NewMessage(inD.Descriptor())
+	if err := protojson.Unmarshal([]byte(`{"attrs": {"owner": {"name": "alice", "tags": ["a", null]}, "items": [{"name": "carol"}, {"name": "bob"}], "deleted": null}}`), in); err != nil {
+		t.Fatal(err)
+	}
+	out := dynamicpb.NewMessage(outD.Descriptor())
+	if err := ts.Conn().Invoke(ctx, "/structtest.StructService/Echo", in, out); err != nil {
+		t.Fatal(err)
+	}
+	b, err := protojson.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]any{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"attrs": map[string]any{"name": "alice", "tags": []any{"a", nil}}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error(diff)
+	}
+
+	r := ts.Requests()[0]
+	if _, ok := r.Struct("attrs.deleted"); ok {
+		t.Error("null value should not be struct")
+	}
+	if _, ok := r.Struct("attrs.items.2"); ok {
+		t.Error("out of range index should not be found")
+	}
+}
+
+func TestConnDialOption(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	called := 0
+	cc := ts.Conn(grpc.WithBlock(), grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		called++
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}))
+	client := routeguide.NewRouteGuideClient(cc)
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := 1; called != want {
+		t.Errorf("got %v\nwant %v", called, want)
+	}
+}
+
+func TestSentHeaders(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("GetFeature").Header("session", "XXXxxXXX").Trailer("size", "213").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	{
+		got := m.SentHeaders()
+		want := []metadata.MD{{"session": {"XXXxxXXX"}}}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Error(diff)
+		}
+	}
+	{
+		got := m.SentTrailers()
+		want := []metadata.MD{{"size": {"213"}}}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Error(diff)
+		}
+	}
+}
+
+func TestSentHeadersStreamingHandlers(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(ts *Server) *matcher
+		call  func(client routeguide.RouteGuideClient) error
+	}{
+		{
+			"ServerStreamHandler",
+			func(ts *Server) *matcher {
+				m := ts.Method("ListFeatures")
+				m.ServerStreamHandler(func(r *Request, s ServerStream) error {
+					return s.Send(Message{"name": "hello"})
+				})
+				return m
+			},
+			func(client routeguide.RouteGuideClient) error {
+				stream, err := client.ListFeatures(context.Background(), &routeguide.Rectangle{})
+				if err != nil {
+					return err
+				}
+				for {
+					if _, err := stream.Recv(); err != nil {
+						if errors.Is(err, io.EOF) {
+							return nil
+						}
+						return err
+					}
+				}
+			},
+		},
+		{
+			"ResponseWriter",
+			func(ts *Server) *matcher {
+				m := ts.Method("ListFeatures")
+				w := m.ResponseWriter()
+				go func() {
+					_ = w.Send(Message{"name": "hello"})
+					w.Close()
+				}()
+				return m
+			},
+			func(client routeguide.RouteGuideClient) error {
+				stream, err := client.ListFeatures(context.Background(), &routeguide.Rectangle{})
+				if err != nil {
+					return err
+				}
+				for {
+					if _, err := stream.Recv(); err != nil {
+						if errors.Is(err, io.EOF) {
+							return nil
+						}
+						return err
+					}
+				}
+			},
+		},
+		{
+			"BidiHandler",
+			func(ts *Server) *matcher {
+				m := ts.Method("RouteChat")
+				m.BidiHandler(func(s BidiStream) error {
+					if _, err := s.Recv(); err != nil {
+						return err
+					}
+					return s.Send(Message{"message": "hello"})
+				})
+				return m
+			},
+			func(client routeguide.RouteGuideClient) error {
+				stream, err := client.RouteChat(context.Background())
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(&routeguide.RouteNote{}); err != nil {
+					return err
+				}
+				if err := stream.CloseSend(); err != nil {
+					return err
+				}
+				for {
+					if _, err := stream.Recv(); err != nil {
+						if errors.Is(err, io.EOF) {
+							return nil
+						}
+						return err
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.DefaultHeader("session", "XXXxxXXX")
+			ts.DefaultTrailer("size", "213")
+			m := tt.setup(ts)
+			if err := tt.call(routeguide.NewRouteGuideClient(ts.Conn())); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(m.SentHeaders(), []metadata.MD{{"session": {"XXXxxXXX"}}}); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(m.SentTrailers(), []metadata.MD{{"size": {"213"}}}); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestStatusWithDetails(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").StatusWithDetails(codes.InvalidArgument, "invalid point", &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: "latitude", Description: "out of range"},
+		},
+	})
+	ts.Method("ListFeatures").StatusCode(codes.Unavailable, "unavailable")
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+
+	_, err := client.GetFeature(ctx, &routeguide.Point{})
+	s := status.Convert(err)
+	if want := codes.InvalidArgument; s.Code() != want {
+		t.Errorf("got %v\nwant %v", s.Code(), want)
+	}
+	details := s.Details()
+	if got, want := len(details), 1; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	br, ok := details[0].(*errdetails.BadRequest)
+	if !ok {
+		t.Fatalf("got %T\nwant *errdetails.BadRequest", details[0])
+	}
+	if want := "latitude"; br.FieldViolations[0].Field != want {
+		t.Errorf("got %v\nwant %v", br.FieldViolations[0].Field, want)
+	}
+
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	if got, want := status.Code(err), codes.Unavailable; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestCompilerFunc(t *testing.T) {
+	tests := []struct {
+		mode            protocompile.SourceInfoMode
+		wantSourceInfos bool
+	}{
+		{protocompile.SourceInfoNone, false},
+		{protocompile.SourceInfoStandard, true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto", CompilerFunc(func(c *protocompile.Compiler) {
+				c.SourceInfoMode = tt.mode
+			}))
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			got := ts.fds[0].SourceLocations().Len() > 0
+			if got != tt.wantSourceInfos {
+				t.Errorf("got %v\nwant %v", got, tt.wantSourceInfos)
+			}
+		})
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto", EnableHealthCheck())
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	if !ts.WaitHealthy(HealthCheckService_DEFAULT, time.Second) {
+		t.Error("want healthy")
+	}
+	if !ts.WaitHealthy(HealthCheckService_FLAPPING, time.Second) {
+		t.Error("want healthy")
+	}
+	if ts.WaitHealthy("unknown", 50*time.Millisecond) {
+		t.Error("want timeout")
+	}
+}
+
+func TestMatcherMethodFullName(t *testing.T) {
+	tests := []struct {
+		method string
+	}{
+		{"/routeguide.RouteGuide/GetFeature"},
+		{"routeguide.RouteGuide/GetFeature"},
+		{"GetFeature"},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			tb := &recordTB{}
+			ts := NewServer(tb, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method(tt.method).Response(map[string]any{"name": "hello"})
+			// The unregistered method is reported, and the matcher never matches.
+			ts.Method("routeguide.RouteGuid/GetFeature").Response(map[string]any{"name": "mismatched"})
+			if got, want := len(tb.errors), 1; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			res, err := client.GetFeature(ctx, &routeguide.Point{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "hello"; res.Name != want {
+				t.Errorf("got %v\nwant %v", res.Name, want)
+			}
+		})
+	}
+}
+
+func TestUnregisteredServiceAndMethod(t *testing.T) {
+	tests := []struct {
+		name       string
+		strict     bool
+		register   func(ts *Server)
+		wantErrors int
+		wantFatals int
+	}{
+		{"registered", false, func(ts *Server) {
+			ts.Service("routeguide.RouteGuide").Method("GetFeature")
+			ts.Method("/routeguide.RouteGuide/ListFeatures")
+			ts.Servicef("/%s", "routeguide.RouteGuide")
+		}, 0, 0},
+		{"unregistered method", false, func(ts *Server) { ts.Method("GetFeatur") }, 1, 0},
+		{"unregistered method of service", false, func(ts *Server) { ts.Method("hello.GrpcTestService/GetFeature") }, 1, 0},
+		{"unregistered service", false, func(ts *Server) { ts.Service("routeguide.Unknown") }, 1, 0},
+		{"unregistered method in matcher", false, func(ts *Server) { ts.Service("routeguide.RouteGuide").Method("GetFeatur") }, 1, 0},
+		{"strict registered", true, func(ts *Server) {
+			ts.Service("routeguide.RouteGuide").Method("GetFeature")
+			ts.Method("/routeguide.RouteGuide/ListFeatures")
+		}, 0, 0},
+		{"strict unregistered method", true, func(ts *Server) { ts.Method("GetFeatur") }, 1, 1},
+		{"strict unregistered method of service", true, func(ts *Server) { ts.Method("hello.GrpcTestService/GetFeature") }, 1, 1},
+		{"strict unregistered service", true, func(ts *Server) { ts.Service("routeguide.Unknown") }, 1, 1},
+		{"strict unregistered method in matcher", true, func(ts *Server) { ts.Service("routeguide.RouteGuide").Method("GetFeatur") }, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := &recordTB{}
+			ts := NewServer(tb, "testdata/route_guide.proto", Proto("testdata/hello.proto"))
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			if tt.strict {
+				ts.Strict()
+			}
+			tt.register(ts)
+			if got := len(tb.errors); got != tt.wantErrors {
+				t.Errorf("got %v\nwant %v", got, tt.wantErrors)
+			}
+			if got := len(tb.fatals); got != tt.wantFatals {
+				t.Errorf("got %v\nwant %v", got, tt.wantFatals)
+			}
+		})
+	}
+}
+
+func TestSetHealthStatus(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto", EnableHealthCheck())
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	client := healthpb.NewHealthClient(ts.Conn())
+	for _, want := range []healthpb.HealthCheckResponse_ServingStatus{
+		healthpb.HealthCheckResponse_NOT_SERVING,
+		healthpb.HealthCheckResponse_SERVING,
+	} {
+		ts.SetHealthStatus(HealthCheckService_DEFAULT, want)
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{
+			Service: HealthCheckService_DEFAULT,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != want {
+			t.Errorf("got %v\nwant %v", res.Status, want)
+		}
+	}
+}
+
+func TestInt64AsNumber(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		want any
+	}{
+		{nil, "35"},
+		{[]Option{Int64AsNumber()}, int64(35)},
+	}
+	ctx := context.Background()
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			ts := NewServer(t, "testdata/hello.proto", tt.opts...)
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("Hello").Response(map[string]any{"message": "hello"})
+			client := hello.NewGrpcTestServiceClient(ts.Conn())
+			if _, err := client.Hello(ctx, &hello.HelloRequest{Num: 35}); err != nil {
+				t.Fatal(err)
+			}
+			got := ts.Requests()[0].Message["num"]
+			if got != tt.want {
+				t.Errorf("got %#v\nwant %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInt64AsNumberWrappers(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		want Message
+	}{
+		{nil, Message{"id": "-35", "size": "18446744073709551615", "ids": []any{"1", "2"}}},
+		{[]Option{Int64AsNumber()}, Message{"id": int64(-35), "size": uint64(18446744073709551615), "ids": []any{int64(1), int64(2)}}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			ts := NewServer(t, "testdata/wkt.proto", tt.opts...)
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("Get").Response(map[string]any{})
+			if _, err := invoke(t, ts, "/wkt.WKTService/Get", `{"id": "-35", "size": "18446744073709551615", "ids": ["1", "2"]}`); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(ts.Requests()[0].Message, tt.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestHealthCheckFlapInterval(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto", EnableHealthCheck(), HealthCheckFlapInterval(10*time.Millisecond))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	client := healthpb.NewHealthClient(ts.Conn())
+	seen := map[healthpb.HealthCheckResponse_ServingStatus]struct{}{}
+	for i := 0; i < 20 && len(seen) < 2; i++ {
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{
+			Service: HealthCheckService_FLAPPING,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[res.Status] = struct{}{}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, want := len(seen), 2; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestStop(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto", GracefulTimeout(10*time.Second))
+	started := make(chan struct{})
+	ts.Method("ListFeatures").ServerStreamHandler(func(r *Request, s ServerStream) error {
+		close(started)
+		<-s.Context().Done()
+		return nil
+	})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.ListFeatures(ctx, &routeguide.Rectangle{}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	start := time.Now()
+	ts.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got %v\nwant immediate shutdown", elapsed)
+	}
+	if ts.status != status_closed {
+		t.Errorf("got %v\nwant %v", ts.status, status_closed)
+	}
+}
+
+func TestGracefulTimeoutInvalid(t *testing.T) {
+	tests := []struct {
+		d       time.Duration
+		wantErr bool
+	}{
+		{time.Second, false},
+		{0, true},
+		{-time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.d.String(), func(t *testing.T) {
+			err := GracefulTimeout(tt.d)(&config{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v\nwantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewServerWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := NewServerWithContext(ctx, t, "testdata/route_guide.proto", EnableHealthCheck(), HealthCheckFlapInterval(10*time.Millisecond))
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(context.Background(), &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-ts.done:
+	case <-time.After(time.Second):
+		t.Fatal("want server to be shut down")
+	}
+	for i := 0; i < 100 && ts.getStatus() != status_closed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := ts.getStatus(), status_closed; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if _, err := client.GetFeature(context.Background(), &routeguide.Point{}); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestNewServerWithContextAndClose(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		tb := &recordTB{}
+		ts := NewServerWithContext(ctx, tb, "testdata/route_guide.proto")
+		// Close and the cancellation of ctx shut down the server concurrently.
+		wg := &sync.WaitGroup{}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cancel()
+		}()
+		go func() {
+			defer wg.Done()
+			ts.Close()
+		}()
+		wg.Wait()
+		ts.Stop()
+		for j := 0; j < 100 && ts.getStatus() != status_closed; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got, want := ts.getStatus(), status_closed; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if len(tb.errors) > 0 {
+			t.Errorf("got %v\nwant no errors", tb.errors)
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto", EnableHealthCheck())
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	started := make(chan struct{})
+	ts.Method("ListFeatures").ServerStreamHandler(func(r *Request, s ServerStream) error {
+		close(started)
+		<-s.Context().Done()
+		return nil
+	})
+	ts.SetHealthStatus("custom", healthpb.HealthCheckResponse_NOT_SERVING)
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	addr := ts.Addr()
+
+	ts.Restart()
+
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v\nwant %v", status.Code(err), codes.Unavailable)
+	}
+	if got := ts.Addr(); got != addr {
+		t.Errorf("got %v\nwant %v", got, addr)
+	}
+	res, err := client.GetFeature(ctx, &routeguide.Point{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "hello"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(ts.Requests()), 3; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	hres, err := healthpb.NewHealthClient(ts.Conn()).Check(ctx, &healthpb.HealthCheckRequest{Service: "custom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hres.Status, healthpb.HealthCheckResponse_NOT_SERVING; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestRestartConcurrently(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ts.Restart()
+		}()
+		go func() {
+			defer wg.Done()
+			_ = ts.Addr()
+			_ = ts.NewConn()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRestartAfterClose(t *testing.T) {
+	tb := &recordTB{}
+	ts := NewServer(tb, "testdata/route_guide.proto")
+	ts.Close()
+	ts.Restart()
+	if got, want := len(tb.errors), 1; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if got, want := tb.errors[0], "server is already closed"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := ts.getStatus(), status_closed; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ctx := context.Background()
+	cacert, err := os.ReadFile("testdata/cacert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := os.ReadFile("testdata/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert := newSelfSignedCert(t, "alice")
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert.Leaf)
+	ts := NewTLSServer(t, "testdata/route_guide.proto", cacert, cert, key, RequireClientCert(pool))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return len(r.PeerCertificates) > 0 && r.PeerCertificates[0].Subject.CommonName == "alice"
+	}).Response(map[string]any{"name": "hello"})
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(cacert)
+	tests := []struct {
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{[]tls.Certificate{clientCert}, false},
+		{nil, true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			creds := credentials.NewTLS(&tls.Config{
+				RootCAs:      roots,
+				Certificates: tt.certs,
+			})
+			cc, err := grpc.Dial(ts.Addr(), grpc.WithTransportCredentials(creds))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = cc.Close()
+			})
+			client := routeguide.NewRouteGuideClient(cc)
+			_, err = client.GetFeature(ctx, &routeguide.Point{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v\nwantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequireClientCertWithoutTLS(t *testing.T) {
+	_, err := newServer(context.Background(), t, "testdata/route_guide.proto", RequireClientCert(x509.NewCertPool()))
+	if err == nil {
+		t.Error("want error")
+	}
+}
+
+func newSelfSignedCert(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  k,
+		Leaf:        leaf,
+	}
+}
+
+func TestUseTLSInvalid(t *testing.T) {
+	cacert, err := os.ReadFile("testdata/cacert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := os.ReadFile("testdata/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile("testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cacert  []byte
+		cert    []byte
+		key     []byte
+		wantErr string
+	}{
+		{"valid", cacert, cert, key, ""},
+		{"valid without cacert", nil, cert, key, ""},
+		{"empty cert", cacert, nil, key, "UseTLS requires non-empty cert and key"},
+		{"empty key", cacert, cert, []byte{}, "UseTLS requires non-empty cert and key"},
+		{"invalid cert", cacert, []byte("invalid"), key, "UseTLS requires valid PEM encoded cert and key"},
+		{"cert and key swapped", cacert, key, cert, "UseTLS requires valid PEM encoded cert and key"},
+		{"invalid cacert", []byte("invalid"), cert, key, "UseTLS requires PEM encoded cacert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := UseTLS(tt.cacert, tt.cert, tt.key)(&config{})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got %v\nwant no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("got %v\nwant %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequestPeer(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	ts.Method("ListFeatures").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range ts.Requests() {
+		if !strings.HasPrefix(r.Peer, "127.0.0.1:") {
+			t.Errorf("got %v\nwant 127.0.0.1:*", r.Peer)
+		}
+	}
+}
+
+func TestDiamondImports(t *testing.T) {
+	tests := []struct {
+		name      string
+		protopath string
+		opts      []Option
+	}{
+		{"proto first", "testdata/diamond/*.proto", []Option{ImportPath("testdata")}},
+		{"other proto first", "testdata/route_guide.proto", []Option{Proto("testdata/diamond/*.proto"), ImportPath("testdata")}},
+		{"import path first", "testdata/route_guide.proto", []Option{ImportPath("testdata"), Proto("testdata/diamond/*.proto")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, tt.protopath, tt.opts...)
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("Get").Response(map[string]any{"d": map[string]any{"name": "hello"}})
+			got, err := invoke(t, ts, "/diamond.DiamondService/Get", `{"d": {"name": "alice"}}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, map[string]any{"d": map[string]any{"name": "hello"}}); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestImportPathOnly(t *testing.T) {
+	tests := []struct {
+		proto string
+	}{
+		{"testdata/imports/svc/item.proto"},
+		{"testdata/imports/svc/*.proto"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			ts := NewServer(t, tt.proto, ImportPath("testdata/imports/lib"))
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("Get").Response(map[string]any{"name": "hello"})
+			got, err := invoke(t, ts, "/item.ItemService/Get", `{"name": "alice"}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, map[string]any{"name": "hello"}); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestMatcherPriority(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "catch-all"})
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return r.Message["latitude"] == float64(10)
+	}).Priority(1).Response(map[string]any{"name": "specific"})
+	ts.Method("GetFeature").Priority(-1).Response(map[string]any{"name": "never"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		latitude int32
+		want     string
+	}{
+		{10, "specific"},
+		{11, "catch-all"},
+	}
+	for _, tt := range tests {
+		res, err := client.GetFeature(ctx, &routeguide.Point{Latitude: tt.latitude})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Name; got != tt.want {
+			t.Errorf("got %v\nwant %v", got, tt.want)
+		}
+	}
+}
+
+func TestRequestMatchedBy(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	first := ts.Method("GetFeature").Match(func(r *Request) bool {
+		return r.Message["latitude"] == float64(1)
+	}).Response(map[string]any{"name": "first"})
+	second := ts.Method("GetFeature").Response(map[string]any{"name": "second"})
+	var matchedInHandler *matcher
+	third := ts.Method("ListFeatures")
+	third.ServerStreamHandler(func(r *Request, s ServerStream) error {
+		matchedInHandler = r.MatchedBy()
+		return nil
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	for _, lat := range []int32{1, 2} {
+		if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: lat}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v\nwant %v", err, io.EOF)
+	}
+	rs, err := client.RecordRoute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Send(&routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.CloseAndRecv(); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("got %v\nwant %v", status.Code(err), codes.Unimplemented)
+	}
+	if got := ts.UnmatchedRequests()[0].MatchedBy(); got != nil {
+		t.Errorf("got %v\nwant nil", got)
+	}
+
+	requests := ts.Requests()
+	if got, want := len(requests), 3; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	for i, want := range []*matcher{first, second, third} {
+		if got := requests[i].MatchedBy(); got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+	if matchedInHandler != third {
+		t.Errorf("got %v\nwant %v", matchedInHandler, third)
+	}
+	if got, want := second.Requests()[0].MatchedBy().String(), "matcher[1] (method=GetFeature)"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestRegisterMatchersWhileServing(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	// Modify the matcher in use and register new matchers while the traffic is in flight.
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			m.Match(func(r *Request) bool {
+				return true
+			}).Header("n", fmt.Sprintf("%d", j))
+			if j%10 == 0 {
+				ts.Method("GetFeature").Priority(-1).Response(map[string]any{"name": "never"})
+				ts.Unmatched(func(r *Request, md protoreflect.MethodDescriptor) *Response {
+					return NewResponse()
+				})
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				res, err := client.GetFeature(ctx, &routeguide.Point{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got, want := res.Name, "hello"; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := len(ts.Requests()), 200; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestAny(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto", Proto("testdata/hello.proto"))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Any().Header("layer", "default")
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return r.Message["latitude"] == float64(10)
+	}).Header("layer", "override")
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		latitude int32
+		want     string
+	}{
+		{10, "override"},
+		{11, "default"},
+	}
+	for _, tt := range tests {
+		var header metadata.MD
+		if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: tt.latitude}, grpc.Header(&header)); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := header.Get("layer"), []string{tt.want}; !cmp.Equal(got, want) {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+	var header metadata.MD
+	if _, err := hello.NewGrpcTestServiceClient(ts.Conn()).Hello(ctx, &hello.HelloRequest{}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header.Get("layer"), []string{"default"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestMatcherStreamingKinds(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Service("routeguide.RouteGuide").Unary().Response(map[string]any{"name": "unary"})
+	ts.Service("routeguide.RouteGuide").ServerStreaming().ClientStreaming().Response(map[string]any{"message": "bidi"})
+	ts.Service("routeguide.RouteGuide").ServerStreaming().Response(map[string]any{"name": "server streaming"})
+	ts.Service("routeguide.RouteGuide").ClientStreaming().Response(map[string]any{"point_count": 3})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	{
+		res, err := client.GetFeature(ctx, &routeguide.Point{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.Name, "unary"; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+	{
+		stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.Name, "server streaming"; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+	{
+		stream, err := client.RecordRoute(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&routeguide.Point{}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.PointCount, int32(3); got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+	{
+		stream, err := client.RouteChat(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&routeguide.RouteNote{}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.Message, "bidi"; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		_ = stream.CloseSend()
+	}
+}
+
+func TestAssertExactCalls(t *testing.T) {
+	tests := []struct {
+		calls      int
+		wantErrors int
+	}{
+		{1, 1},
+		{2, 0},
+		{3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d calls", tt.calls), func(t *testing.T) {
+			ctx := context.Background()
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("GetFeature").AssertExactCalls(2).Response(map[string]any{"name": "hello"})
+			ts.Method("ListFeatures").AssertExactCalls(0)
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			for i := 0; i < tt.calls; i++ {
+				if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tb := &recordTB{}
+			ts.AssertExpectations(tb)
+			if got := len(tb.errors); got != tt.wantErrors {
+				t.Errorf("got %v\nwant %v", got, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestOnce(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	once := ts.Method("GetFeature").Once().StatusCode(codes.Unavailable, "unavailable")
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v\nwant %v", status.Code(err), codes.Unavailable)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := client.GetFeature(ctx, &routeguide.Point{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.Name, "hello"; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+	if got, want := len(once.Requests()), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestTimesConcurrent(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	limited := ts.Method("GetFeature").Times(3).Response(map[string]any{"name": "limited"})
+	ts.Method("GetFeature").Response(map[string]any{"name": "fallback"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := len(limited.Requests()), 3; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestAssertExactCallsOnClose(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	tb := &recordTB{}
+	ts.t = tb
+	ts.Method("GetFeature").AssertExactCalls(1).Response(map[string]any{"name": "hello"})
+	ts.Close()
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestAssertExpectations(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Service("routeguide.RouteGuide").Method("GetFeature").AssertMinCalls(1).AssertMaxCalls(2).Response(map[string]any{"name": "hello"})
+	ts.Method("ListFeatures").AssertMinCalls(1)
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tb := &recordTB{}
+	ts.AssertExpectations(tb)
+	want := []string{
+		"matcher[0] (service=routeguide.RouteGuide, method=GetFeature): called 3 times, want at most 2",
+		"matcher[1] (method=ListFeatures): called 0 times, want at least 1",
+	}
+	if diff := cmp.Diff(tb.errors, want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestOnRequestAndOnResponse(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return r.Message["latitude"] == float64(10)
+	}).Response(map[string]any{"name": "hello"})
+	ts.Method("RecordRoute").Response(map[string]any{"point_count": 2})
+
+	var (
+		mu        sync.Mutex
+		requests  []string
+		responses []string
+	)
+	ts.OnRequest(func(r *Request) {
+		// Calling methods of the server in callbacks must not deadlock.
+		_ = ts.Requests()
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, fmt.Sprintf("%s %v", r.Method, r.Message["latitude"]))
+	})
+	ts.OnResponse(func(r *Request, res *Response) {
+		_ = ts.UnmatchedRequests()
+		mu.Lock()
+		defer mu.Unlock()
+		responses = append(responses, fmt.Sprintf("%s %v %v", r.Method, res.Status.Code(), len(res.Messages)))
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 1}); err == nil {
+		t.Error("want error")
+	}
+	stream, err := client.RecordRoute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lat := range []int32{1, 2} {
+		if err := stream.Send(&routeguide.Point{Latitude: lat}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"GetFeature 10", "GetFeature 1", "RecordRoute 1", "RecordRoute 2"}; !cmp.Equal(requests, want) {
+		t.Errorf("got %v\nwant %v", requests, want)
+	}
+	if want := []string{"GetFeature OK 1", "GetFeature Unimplemented 0", "RecordRoute OK 1"}; !cmp.Equal(responses, want) {
+		t.Errorf("got %v\nwant %v", responses, want)
+	}
+}
+
+func TestDumpRequests(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(metadata.AppendToOutgoingContext(ctx, "x-dump", "yes"), &routeguide.Point{Latitude: 10}); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := ts.DumpRequests(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "[\n  {\n") {
+		t.Errorf("want indented JSON\ngot %v", buf.String())
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %v\nwant %v", len(got), 1)
+	}
+	if got, want := got[0]["method"], "GetFeature"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := got[0]["message"].(map[string]any)["latitude"], float64(10); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := got[0]["headers"].(map[string]any)["x-dump"], []any{"yes"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestDefaultHeaderAndTrailer(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.DefaultHeader("server-version", "v1")
+	ts.DefaultTrailer("server-trailer", "default")
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return r.Message["latitude"] == float64(1)
+	}).Header("server-version", "v2").Response(map[string]any{"name": "override"})
+	ts.Method("GetFeature").Response(map[string]any{"name": "default"})
+	ts.Method("ListFeatures").ServerStreamHandler(func(r *Request, s ServerStream) error {
+		return s.Send(Message{"name": "stream"})
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		name        string
+		latitude    int32
+		wantHeader  []string
+		wantTrailer []string
+	}{
+		{"default", 0, []string{"v1"}, []string{"default"}},
+		{"matcher takes precedence", 1, []string{"v2"}, []string{"default"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header, trailer metadata.MD
+			if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: tt.latitude}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+				t.Fatal(err)
+			}
+			if got := header.Get("server-version"); !cmp.Equal(got, tt.wantHeader) {
+				t.Errorf("got %v\nwant %v", got, tt.wantHeader)
+			}
+			if got := trailer.Get("server-trailer"); !cmp.Equal(got, tt.wantTrailer) {
+				t.Errorf("got %v\nwant %v", got, tt.wantTrailer)
+			}
+		})
+	}
+
+	t.Run("server stream handler", func(t *testing.T) {
+		stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := stream.Recv(); err != nil {
+				if !errors.Is(err, io.EOF) {
+					t.Fatal(err)
+				}
+				break
+			}
+		}
+		header, err := stream.Header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := header.Get("server-version"), []string{"v1"}; !cmp.Equal(got, want) {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := stream.Trailer().Get("server-trailer"), []string{"default"}; !cmp.Equal(got, want) {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	})
+}
+
+func TestAssertCalledInOrder(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	ts.Method("RecordRoute").Response(map[string]any{"point_count": 1})
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.RecordRoute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"routeguide.RouteGuide/GetFeature", "routeguide.RouteGuide/RecordRoute", "routeguide.RouteGuide/GetFeature"}
+	if got := ts.RequestOrder(); !cmp.Equal(got, want) {
 		t.Errorf("got %v\nwant %v", got, want)
 	}
+
+	tests := []struct {
+		steps      []string
+		wantErrors int
+	}{
+		{[]string{"GetFeature", "RecordRoute"}, 0},
+		{[]string{"RecordRoute", "GetFeature"}, 0},
+		{[]string{"GetFeature", "GetFeature"}, 0},
+		{[]string{"/routeguide.RouteGuide/GetFeature", "routeguide.RouteGuide/RecordRoute", "GetFeature"}, 0},
+		{[]string{}, 0},
+		{[]string{"RecordRoute", "RecordRoute"}, 1},
+		{[]string{"GetFeature", "RouteChat"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.steps), func(t *testing.T) {
+			tb := &recordTB{}
+			ts.AssertCalledInOrder(tb, tt.steps...)
+			if got := len(tb.errors); got != tt.wantErrors {
+				t.Errorf("got %v\nwant %v", got, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestUnmatchedStatus(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		code        codes.Code
+		msg         string
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		{"default", codes.OK, "", codes.Unimplemented, "Unimplemented: no matcher for routeguide.RouteGuide/%s"},
+		{"code", codes.NotFound, "", codes.NotFound, "NotFound: no matcher for routeguide.RouteGuide/%s"},
+		{"code and message", codes.FailedPrecondition, "no stub", codes.FailedPrecondition, "no stub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			if tt.code != codes.OK {
+				ts.UnmatchedStatus(tt.code, tt.msg)
+			}
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			calls := map[string]func() error{
+				"GetFeature": func() error {
+					_, err := client.GetFeature(ctx, &routeguide.Point{})
+					return err
+				},
+				"ListFeatures": func() error {
+					stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+					if err != nil {
+						return err
+					}
+					_, err = stream.Recv()
+					return err
+				},
+				"RecordRoute": func() error {
+					stream, err := client.RecordRoute(ctx)
+					if err != nil {
+						return err
+					}
+					_, err = stream.CloseAndRecv()
+					return err
+				},
+				"RouteChat": func() error {
+					stream, err := client.RouteChat(ctx)
+					if err != nil {
+						return err
+					}
+					if err := stream.Send(&routeguide.RouteNote{}); err != nil {
+						return err
+					}
+					_, err = stream.Recv()
+					return err
+				},
+			}
+			for method, call := range calls {
+				s := status.Convert(call())
+				if got, want := s.Code(), tt.wantCode; got != want {
+					t.Errorf("%s: got %v\nwant %v", method, got, want)
+				}
+				want := tt.wantMessage
+				if strings.Contains(want, "%s") {
+					want = fmt.Sprintf(want, method)
+				}
+				if got := s.Message(); got != want {
+					t.Errorf("%s: got %v\nwant %v", method, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		ts := NewServer(t, "testdata/route_guide.proto")
+		t.Cleanup(func() {
+			ts.Close()
+		})
+		tb := &recordTB{}
+		ts.t = tb
+		ts.UnmatchedStatus(codes.OK, "")
+		ts.t = t
+		if got, want := len(tb.fatals), 1; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	})
 }
@@ -0,0 +1,147 @@
+package grpcstub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	grpcWebTrailerFlag     = 0x80
+)
+
+// GRPCWebHandler returns http.Handler which serves the registered services over gRPC-Web.
+// Both the binary ( application/grpc-web ) and the text ( application/grpc-web-text ) content types are supported.
+// CORS is not handled, so wrap the handler if the client is a browser on another origin.
+func (s *Server) GRPCWebHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ct := r.Header.Get("Content-Type")
+		if !strings.HasPrefix(ct, grpcWebContentType) {
+			http.Error(w, fmt.Sprintf("invalid gRPC-Web request content-type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		text := strings.HasPrefix(ct, grpcWebTextContentType)
+		// Translate the gRPC-Web request into the gRPC request served by *grpc.Server.
+		req := r.Clone(r.Context())
+		req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2"
+		req.Header.Set("Content-Type", grpcContentType(ct))
+		req.Header.Del("Content-Length")
+		req.ContentLength = -1
+		if text {
+			req.Body = io.NopCloser(base64.NewDecoder(base64.StdEncoding, r.Body))
+		}
+		gw := newGRPCWebResponseWriter(w, ct, text)
+		s.getGRPCServer().ServeHTTP(gw, req)
+		gw.finish()
+	})
+}
+
+// grpcContentType returns the gRPC content-type corresponding to the gRPC-Web content-type ct.
+func grpcContentType(ct string) string {
+	if strings.HasPrefix(ct, grpcWebTextContentType) {
+		return "application/grpc" + strings.TrimPrefix(ct, grpcWebTextContentType)
+	}
+	return "application/grpc" + strings.TrimPrefix(ct, grpcWebContentType)
+}
+
+var _ http.Flusher = (*grpcWebResponseWriter)(nil)
+
+// grpcWebResponseWriter is http.ResponseWriter which translates the gRPC response written by *grpc.Server into the gRPC-Web response.
+// Trailers are sent in the body as the trailer frame.
+type grpcWebResponseWriter struct {
+	w             http.ResponseWriter
+	header        http.Header
+	contentType   string
+	text          bool
+	buf           bytes.Buffer
+	headerWritten bool
+}
+
+func newGRPCWebResponseWriter(w http.ResponseWriter, contentType string, text bool) *grpcWebResponseWriter {
+	return &grpcWebResponseWriter{
+		w:           w,
+		header:      http.Header{},
+		contentType: contentType,
+		text:        text,
+	}
+}
+
+func (gw *grpcWebResponseWriter) Header() http.Header {
+	return gw.header
+}
+
+func (gw *grpcWebResponseWriter) WriteHeader(code int) {
+	if gw.headerWritten {
+		return
+	}
+	gw.headerWritten = true
+	h := gw.w.Header()
+	for k, v := range gw.header {
+		if k == "Trailer" || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		h[k] = v
+	}
+	h.Set("Content-Type", gw.contentType)
+	gw.w.WriteHeader(code)
+}
+
+func (gw *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !gw.headerWritten {
+		gw.WriteHeader(http.StatusOK)
+	}
+	return gw.buf.Write(b)
+}
+
+// Flush writes the buffered body. In the text mode, each flushed chunk is base64-encoded separately.
+func (gw *grpcWebResponseWriter) Flush() {
+	if !gw.headerWritten {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.buf.Len() > 0 {
+		b := gw.buf.Bytes()
+		if gw.text {
+			b = []byte(base64.StdEncoding.EncodeToString(b))
+		}
+		_, _ = gw.w.Write(b)
+		gw.buf.Reset()
+	}
+	if f, ok := gw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the trailers set after the header was written as the trailer frame.
+func (gw *grpcWebResponseWriter) finish() {
+	declared := map[string]struct{}{}
+	for _, k := range gw.header.Values("Trailer") {
+		declared[http.CanonicalHeaderKey(k)] = struct{}{}
+	}
+	var lines []string
+	for k, v := range gw.header {
+		name := k
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			name = strings.TrimPrefix(k, http.TrailerPrefix)
+		} else if _, ok := declared[k]; !ok {
+			continue
+		}
+		for _, vv := range v {
+			lines = append(lines, fmt.Sprintf("%s: %s\r\n", strings.ToLower(name), vv))
+		}
+	}
+	sort.Strings(lines)
+	payload := strings.Join(lines, "")
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+	_, _ = gw.Write(frame)
+	gw.Flush()
+}
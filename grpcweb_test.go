@@ -0,0 +1,128 @@
+package grpcstub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGRPCWebHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		text        bool
+	}{
+		{"binary", "application/grpc-web+proto", false},
+		{"text", "application/grpc-web-text", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("GetFeature").Header("hello", "header").Response(map[string]any{"name": "hello"})
+			ts.Method("ListFeatures").StatusCode(codes.NotFound, "not found")
+			hs := httptest.NewServer(ts.GRPCWebHandler())
+			t.Cleanup(func() {
+				hs.Close()
+			})
+
+			{
+				res, frames := postGRPCWeb(t, hs.URL+"/routeguide.RouteGuide/GetFeature", tt.contentType, tt.text, &routeguide.Point{Latitude: 10})
+				if got := res.Header.Get("Content-Type"); got != tt.contentType {
+					t.Errorf("got %v\nwant %v", got, tt.contentType)
+				}
+				if got, want := res.Header.Get("hello"), "header"; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+				if got, want := len(frames), 2; got != want {
+					t.Fatalf("got %v\nwant %v", got, want)
+				}
+				f := &routeguide.Feature{}
+				if err := proto.Unmarshal(frames[0].data, f); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := f.Name, "hello"; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+				if !frames[1].trailer {
+					t.Error("want trailer frame")
+				}
+				if got, want := string(frames[1].data), "grpc-status: 0\r\n"; !strings.Contains(got, want) {
+					t.Errorf("got %v\nwant to contain %v", got, want)
+				}
+			}
+
+			{
+				_, frames := postGRPCWeb(t, hs.URL+"/routeguide.RouteGuide/ListFeatures", tt.contentType, tt.text, &routeguide.Rectangle{})
+				if got, want := len(frames), 1; got != want {
+					t.Fatalf("got %v\nwant %v", got, want)
+				}
+				if got, want := string(frames[0].data), "grpc-status: 5\r\n"; !strings.Contains(got, want) {
+					t.Errorf("got %v\nwant to contain %v", got, want)
+				}
+			}
+
+			if got, want := len(ts.Requests()), 2; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+type grpcWebFrame struct {
+	trailer bool
+	data    []byte
+}
+
+func postGRPCWeb(t *testing.T, url, contentType string, text bool, m proto.Message) (*http.Response, []grpcWebFrame) {
+	t.Helper()
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(b)))
+	body = append(body, b...)
+	if text {
+		body = []byte(base64.StdEncoding.EncodeToString(body))
+	}
+	res, err := http.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	rb, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text {
+		// Each flushed chunk is base64-encoded separately, so decode per 4 bytes.
+		var decoded []byte
+		for i := 0; i+4 <= len(rb); i += 4 {
+			d, err := base64.StdEncoding.DecodeString(string(rb[i : i+4]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded = append(decoded, d...)
+		}
+		rb = decoded
+	}
+	var frames []grpcWebFrame
+	for len(rb) >= 5 {
+		l := binary.BigEndian.Uint32(rb[1:5])
+		frames = append(frames, grpcWebFrame{trailer: rb[0]&0x80 != 0, data: rb[5 : 5+l]})
+		rb = rb[5+l:]
+	}
+	return res, frames
+}
@@ -0,0 +1,103 @@
+package grpcstub
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// inFlightStreamIDKey is the header to identify server streaming calls of the conns created by the server.
+// The conns report the messages received by the client with the id, so that MaxInFlight can limit the messages not received yet.
+const inFlightStreamIDKey = "x-grpcstub-stream-id"
+
+// inFlightStreamInterceptor set the id to server streaming calls and reports the messages received by the client.
+// The calls are passed through as is unless MaxInFlight is set to any matcher.
+func (s *Server) inFlightStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if desc.ClientStreams || !desc.ServerStreams {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	s.mu.Lock()
+	if !s.inFlightLimited {
+		s.mu.Unlock()
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	s.inFlightSeq++
+	id := strconv.FormatUint(s.inFlightSeq, 10)
+	s.mu.Unlock()
+	cs, err := streamer(metadata.AppendToOutgoingContext(ctx, inFlightStreamIDKey, id), desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &inFlightClientStream{ClientStream: cs, s: s, id: id}, nil
+}
+
+type inFlightClientStream struct {
+	grpc.ClientStream
+	s  *Server
+	id string
+}
+
+func (cs *inFlightClientStream) RecvMsg(m any) error {
+	if err := cs.ClientStream.RecvMsg(m); err != nil {
+		return err
+	}
+	cs.s.releaseInFlight(cs.id)
+	return nil
+}
+
+// inFlightServerStream waits before sending a message while n messages are not received by the client.
+type inFlightServerStream struct {
+	grpc.ServerStream
+	sem chan struct{}
+}
+
+func (ss *inFlightServerStream) SendMsg(m any) error {
+	select {
+	case ss.sem <- struct{}{}:
+	case <-ss.Context().Done():
+		return status.FromContextError(ss.Context().Err()).Err()
+	}
+	return ss.ServerStream.SendMsg(m)
+}
+
+// limitInFlight returns the stream which sends at most n messages not received by the client.
+// The stream is reported as the test error and returned as is if the client is not the conn created by the server, because the received messages cannot be known.
+// The returned func must be called when the call is finished.
+func (s *Server) limitInFlight(stream grpc.ServerStream, n int) (grpc.ServerStream, func()) {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	ids := md.Get(inFlightStreamIDKey)
+	if len(ids) == 0 {
+		method, _ := grpc.Method(stream.Context())
+		s.t.Errorf("MaxInFlight is not applied to %s: the client is not the conn created by the server ( e.g. Conn )", method)
+		return stream, func() {}
+	}
+	id := ids[0]
+	sem := make(chan struct{}, n)
+	s.mu.Lock()
+	if s.inFlight == nil {
+		s.inFlight = map[string]chan struct{}{}
+	}
+	s.inFlight[id] = sem
+	s.mu.Unlock()
+	return &inFlightServerStream{ServerStream: stream, sem: sem}, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.inFlight, id)
+	}
+}
+
+func (s *Server) releaseInFlight(id string) {
+	s.mu.RLock()
+	sem, ok := s.inFlight[id]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+	select {
+	case <-sem:
+	default:
+	}
+}
@@ -1,25 +1,45 @@
 package grpcstub
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 type config struct {
-	protos            []string
-	importPaths       []string
-	useTLS            bool
-	cacert, cert, key []byte
-	healthCheck       bool
-	disableReflection bool
+	protos                   []string
+	importPaths              []string
+	protoImportPaths         []string
+	useTLS                   bool
+	cacert, cert, key        []byte
+	clientCAs                *x509.CertPool
+	healthCheck              bool
+	healthCheckFlapInterval  time.Duration
+	disableReflection        bool
+	hideHealthFromReflection bool
+	unixSocket               string
+	serverOpts               []grpc.ServerOption
+	maxSendMsgSize           int
+	streamNoMatchKeepOpen    bool
+	compilerFuncs            []func(*protocompile.Compiler)
+	int64AsNumber            bool
+	requestMarshalOpts       protojson.MarshalOptions
+	gracefulTimeout          time.Duration
 }
 
 type Option func(*config) error
 
-// Proto append proto
+// Proto append proto. proto can be a file, a directory or a glob pattern ( e.g. path/to/**/*.proto ).
 func Proto(proto string) Option {
 	return func(c *config) error {
 		protos := []string{}
@@ -31,7 +51,7 @@ func Proto(proto string) Option {
 			proto = filepath.Join(proto, "*")
 		}
 		base, pattern := doublestar.SplitPattern(filepath.ToSlash(proto))
-		c.importPaths = unique(append(c.importPaths, base))
+		c.protoImportPaths = unique(append(c.protoImportPaths, base))
 		abs, err := filepath.Abs(base)
 		if err != nil {
 			return err
@@ -55,7 +75,7 @@ func Proto(proto string) Option {
 	}
 }
 
-// Protos append protos
+// Protos append protos. All services in protos are registered on the server.
 func Protos(protos []string) Option {
 	return func(c *config) error {
 		for _, p := range protos {
@@ -68,7 +88,10 @@ func Protos(protos []string) Option {
 	}
 }
 
-// ImportPath set import path
+// ImportPath set import path.
+// Imports of protos are resolved against import paths, and protos outside of import paths are resolved against their own directory.
+// Protos are resolved against import paths set by ImportPath before the base directories of patterns given to Proto, regardless of the order of options.
+// Well-known types ( google/protobuf/*.proto ) are always resolvable.
 func ImportPath(path string) Option {
 	return func(c *config) error {
 		c.importPaths = unique(append(c.importPaths, path))
@@ -84,9 +107,30 @@ func ImportPaths(paths []string) Option {
 	}
 }
 
+// CompilerFunc set function to customize protocompile.Compiler used to compile protos.
+// The function is called after the default settings ( import paths and standard imports ) are applied.
+func CompilerFunc(fn func(*protocompile.Compiler)) Option {
+	return func(c *config) error {
+		c.compilerFuncs = append(c.compilerFuncs, fn)
+		return nil
+	}
+}
+
 // UseTLS enable TLS
+// The cert and key are required. If cacert is empty, clients created by Conn skip the verification of the server certificate.
 func UseTLS(cacert, cert, key []byte) Option {
 	return func(c *config) error {
+		if len(cert) == 0 || len(key) == 0 {
+			return errors.New("UseTLS requires non-empty cert and key")
+		}
+		if _, err := tls.X509KeyPair(cert, key); err != nil {
+			return fmt.Errorf("UseTLS requires valid PEM encoded cert and key: %w", err)
+		}
+		if len(cacert) > 0 {
+			if ok := x509.NewCertPool().AppendCertsFromPEM(cacert); !ok {
+				return errors.New("UseTLS requires PEM encoded cacert: no certificates found")
+			}
+		}
 		c.useTLS = true
 		c.cacert = cacert
 		c.cert = cert
@@ -95,6 +139,14 @@ func UseTLS(cacert, cert, key []byte) Option {
 	}
 }
 
+// RequireClientCert require and verify client certificates with pool. It requires TLS ( e.g. NewTLSServer, UseTLS ).
+func RequireClientCert(pool *x509.CertPool) Option {
+	return func(c *config) error {
+		c.clientCAs = pool
+		return nil
+	}
+}
+
 // EnableHealthCheck enable grpc.health.v1
 func EnableHealthCheck() Option {
 	return func(c *config) error {
@@ -103,6 +155,36 @@ func EnableHealthCheck() Option {
 	}
 }
 
+// HealthCheckFlapInterval set the interval of flapping the serving status of the flapping service of health check
+func HealthCheckFlapInterval(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid health check flap interval: %s", d)
+		}
+		c.healthCheckFlapInterval = d
+		return nil
+	}
+}
+
+// GracefulTimeout set the timeout of graceful shutdown by Close
+func GracefulTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid graceful timeout: %s", d)
+		}
+		c.gracefulTimeout = d
+		return nil
+	}
+}
+
+// HideHealthFromReflection hide grpc.health.v1.Health from the service list of Server Reflection Protocol while health check calls still work
+func HideHealthFromReflection() Option {
+	return func(c *config) error {
+		c.hideHealthFromReflection = true
+		return nil
+	}
+}
+
 // DisableReflection disable Server Reflection Protocol
 func DisableReflection() Option {
 	return func(c *config) error {
@@ -111,6 +193,89 @@ func DisableReflection() Option {
 	}
 }
 
+// Reflection enable or disable Server Reflection Protocol ( default true )
+func Reflection(enabled bool) Option {
+	return func(c *config) error {
+		c.disableReflection = !enabled
+		return nil
+	}
+}
+
+// UnixSocket listen on the Unix domain socket of path instead of TCP
+func UnixSocket(path string) Option {
+	return func(c *config) error {
+		c.unixSocket = path
+		return nil
+	}
+}
+
+// WriteBufferSize set the size of write buffer of *grpc.Server
+func WriteBufferSize(n int) Option {
+	return func(c *config) error {
+		c.serverOpts = append(c.serverOpts, grpc.WriteBufferSize(n))
+		return nil
+	}
+}
+
+// ReadBufferSize set the size of read buffer of *grpc.Server
+func ReadBufferSize(n int) Option {
+	return func(c *config) error {
+		c.serverOpts = append(c.serverOpts, grpc.ReadBufferSize(n))
+		return nil
+	}
+}
+
+// MaxRecvMsgSize set the max message size in bytes *grpc.Server can receive
+func MaxRecvMsgSize(n int) Option {
+	return func(c *config) error {
+		c.serverOpts = append(c.serverOpts, grpc.MaxRecvMsgSize(n))
+		return nil
+	}
+}
+
+// MaxSendMsgSize set the max message size in bytes *grpc.Server can send. Conn also uses it as the max message size the client can receive
+func MaxSendMsgSize(n int) Option {
+	return func(c *config) error {
+		c.serverOpts = append(c.serverOpts, grpc.MaxSendMsgSize(n))
+		c.maxSendMsgSize = n
+		return nil
+	}
+}
+
+// ServerOption append grpc.ServerOption used to create *grpc.Server.
+// The options are appended after the TLS credentials option, and interceptors set by the options run around the stub handlers.
+func ServerOption(opts ...grpc.ServerOption) Option {
+	return func(c *config) error {
+		c.serverOpts = append(c.serverOpts, opts...)
+		return nil
+	}
+}
+
+// StreamNoMatchKeepOpen keep server streaming and bidirectional streaming open until the context is done when no matcher matches, instead of returning the status set by Server.UnmatchedStatus
+func StreamNoMatchKeepOpen() Option {
+	return func(c *config) error {
+		c.streamNoMatchKeepOpen = true
+		return nil
+	}
+}
+
+// Int64AsNumber decode 64-bit integer fields ( including Int64Value and UInt64Value wrappers ) of request messages as int64 or uint64 instead of strings encoded by protojson
+func Int64AsNumber() Option {
+	return func(c *config) error {
+		c.int64AsNumber = true
+		return nil
+	}
+}
+
+// RequestMarshalOptions set protojson.MarshalOptions used to build Request.Message.
+// The default is protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true, EmitUnpopulated: true}.
+func RequestMarshalOptions(opts protojson.MarshalOptions) Option {
+	return func(c *config) error {
+		c.requestMarshalOpts = opts
+		return nil
+	}
+}
+
 func unique(in []string) []string {
 	u := []string{}
 	m := map[string]struct{}{}
@@ -0,0 +1,57 @@
+package grpcstub
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ClientRecord is a record of a unary call seen by client.
+type ClientRecord struct {
+	Method   string
+	Response any
+	Headers  metadata.MD
+	Trailers metadata.MD
+	Status   *status.Status
+}
+
+// ClientRecorder records unary calls seen by client via the interceptor returned by RecordingClientInterceptor.
+type ClientRecorder struct {
+	records []*ClientRecord
+	mu      sync.RWMutex
+}
+
+// RecordingClientInterceptor returns grpc.UnaryClientInterceptor which records responses, headers, trailers and statuses received by client, and the recorder.
+func RecordingClientInterceptor() (grpc.UnaryClientInterceptor, *ClientRecorder) {
+	cr := &ClientRecorder{}
+	return cr.intercept, cr
+}
+
+// Records returns []*grpcstub.ClientRecord recorded by recorder.
+func (cr *ClientRecorder) Records() []*ClientRecord {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.records
+}
+
+func (cr *ClientRecorder) intercept(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var h, t metadata.MD
+	opts = append(opts, grpc.Header(&h), grpc.Trailer(&t))
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	r := &ClientRecord{
+		Method:   method,
+		Headers:  h,
+		Trailers: t,
+		Status:   status.Convert(err),
+	}
+	if err == nil {
+		r.Response = reply
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.records = append(cr.records, r)
+	return err
+}
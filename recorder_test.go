@@ -0,0 +1,68 @@
+package grpcstub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestRecordingClientInterceptor(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return r.Message["latitude"].(float64) == 10
+	}).Header("session", "XXXxxXXX").Response(map[string]any{"name": "hello"})
+	ts.Method("GetFeature").ResponseErrorf(codes.NotFound, "not found")
+
+	icpt, rec := RecordingClientInterceptor()
+	cc, err := grpc.Dial(ts.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithUnaryInterceptor(icpt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cc.Close()
+	})
+	client := routeguide.NewRouteGuideClient(cc)
+	if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 20}); err == nil {
+		t.Error("want error")
+	}
+
+	records := rec.Records()
+	if got, want := len(records), 2; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	{
+		r := records[0]
+		if want := "/routeguide.RouteGuide/GetFeature"; r.Method != want {
+			t.Errorf("got %v\nwant %v", r.Method, want)
+		}
+		if want := "hello"; r.Response.(*routeguide.Feature).Name != want {
+			t.Errorf("got %v\nwant %v", r.Response.(*routeguide.Feature).Name, want)
+		}
+		if want := "XXXxxXXX"; r.Headers.Get("session")[0] != want {
+			t.Errorf("got %v\nwant %v", r.Headers.Get("session"), want)
+		}
+		if want := codes.OK; r.Status.Code() != want {
+			t.Errorf("got %v\nwant %v", r.Status.Code(), want)
+		}
+	}
+	{
+		r := records[1]
+		if r.Response != nil {
+			t.Errorf("got %v\nwant nil", r.Response)
+		}
+		if want := codes.NotFound; r.Status.Code() != want {
+			t.Errorf("got %v\nwant %v", r.Status.Code(), want)
+		}
+	}
+}
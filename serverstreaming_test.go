@@ -3,10 +3,22 @@ package grpcstub
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 func TestServerStreaming(t *testing.T) {
@@ -108,3 +120,643 @@ func TestServerStreamingUnmatched(t *testing.T) {
 		}
 	}
 }
+
+func TestServerStreamingResponseUnknownField(t *testing.T) {
+	ctx := context.Background()
+	tb := &recordTB{}
+	ts := NewServer(tb, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").Response(map[string]any{"name": "hello", "nmae": "typo"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Error("want error")
+	}
+	if got, want := len(tb.errors), 1; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if want := `unknown field "nmae"`; !strings.Contains(tb.errors[0], want) {
+		t.Errorf("got %v\nwant to contain %v", tb.errors[0], want)
+	}
+}
+
+func TestServerStreamingResponseInterval(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	interval := 50 * time.Millisecond
+	ts.Method("ListFeatures").ResponseInterval(interval).Response(map[string]any{"name": "a"}).Response(map[string]any{"name": "b"}).Response(map[string]any{"name": "c"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []time.Time
+	for {
+		_, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, time.Now())
+	}
+	if got, want := len(received), 3; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	for i := 1; i < len(received); i++ {
+		if got := received[i].Sub(received[i-1]); got < interval/2 {
+			t.Errorf("interval between messages[%d] and messages[%d]: got %v\nwant about %v", i-1, i, got, interval)
+		}
+	}
+}
+
+func TestServerStreamingResponseIntervalCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	ts.Method("ListFeatures").ResponseInterval(time.Hour).Response(map[string]any{"name": "a"}).Response(map[string]any{"name": "b"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	cancel()
+	_, err = stream.Recv()
+	if got, want := status.Code(err), codes.Canceled; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	// The handler must return without waiting for the interval, otherwise Close waits for the graceful timeout.
+	ts.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handler returned after %v", elapsed)
+	}
+}
+
+func TestServerStreamingMessagesThenStatus(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").Response(map[string]any{"name": "a"}).Response(map[string]any{"name": "b"}).Status(status.New(codes.ResourceExhausted, "exhausted"))
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if got, want := status.Code(err), codes.ResourceExhausted; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+			break
+		}
+		got = append(got, res.Name)
+	}
+	if want := []string{"a", "b"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestServerStreamingResponseProtoMismatch(t *testing.T) {
+	ctx := context.Background()
+	tb := &recordTB{}
+	ts := NewServer(tb, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").ResponseProto(&routeguide.Point{Latitude: 1})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	if got, want := status.Code(err), codes.Internal; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestServerStreamingValidateRequest(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").ValidateRequest(func(r *Request, md protoreflect.MethodDescriptor) error {
+		if _, ok := r.Message["lo"].(map[string]any); !ok {
+			return errors.New("lo is required")
+		}
+		return nil
+	}).Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No message is sent before the status.
+	_, err = stream.Recv()
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestServerStreamHandler(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").ServerStreamHandler(func(r *Request, s ServerStream) error {
+		lo := r.Message["lo"].(map[string]any)
+		hi := r.Message["hi"].(map[string]any)
+		for i := int(lo["latitude"].(float64)); i < int(hi["latitude"].(float64)); i++ {
+			if err := s.Send(Message{"name": fmt.Sprintf("feature[%d]", i)}); err != nil {
+				return err
+			}
+		}
+		return status.Error(codes.Aborted, "aborted")
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{
+		Lo: &routeguide.Point{
+			Latitude:  int32(10),
+			Longitude: int32(2),
+		},
+		Hi: &routeguide.Point{
+			Latitude:  int32(13),
+			Longitude: int32(7),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := 0
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if got := status.Code(err); got != codes.Aborted {
+				t.Errorf("got %v\nwant %v", got, codes.Aborted)
+			}
+			break
+		}
+		if want := fmt.Sprintf("feature[%d]", c+10); res.Name != want {
+			t.Errorf("got %v\nwant %v", res.Name, want)
+		}
+		c++
+	}
+	if want := 3; c != want {
+		t.Errorf("got %v\nwant %v", c, want)
+	}
+}
+
+func BenchmarkServerStreamingBufferSize(b *testing.B) {
+	ctx := context.Background()
+	sizes := []int{0, 32 * 1024, 1024 * 1024}
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			ts := NewServer(b, "testdata/route_guide.proto", WriteBufferSize(size), ReadBufferSize(size))
+			b.Cleanup(func() {
+				ts.Close()
+			})
+			m := ts.Method("ListFeatures")
+			for i := 0; i < 100; i++ {
+				m.Response(map[string]any{"name": fmt.Sprintf("feature[%d]", i)})
+			}
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					if _, err := stream.Recv(); err != nil {
+						if !errors.Is(err, io.EOF) {
+							b.Fatal(err)
+						}
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestServerStreamingNoMatchKeepOpen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := NewServer(t, "testdata/route_guide.proto", StreamNoMatchKeepOpen())
+	t.Cleanup(func() {
+		ts.Close()
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error)
+	go func() {
+		_, err := stream.Recv()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("stream is closed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	if got := status.Code(<-errc); got != codes.Canceled {
+		t.Errorf("got %v\nwant %v", got, codes.Canceled)
+	}
+	{
+		got := len(ts.UnmatchedRequests())
+		if want := 1; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+}
+
+func TestServerStreamingBackpressure(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	const (
+		total = 100
+		size  = 16 * 1024
+	)
+	var sent int64
+	ts.Method("ListFeatures").ServerStreamHandler(func(r *Request, s ServerStream) error {
+		for i := 0; i < total; i++ {
+			if err := s.Send(Message{"name": strings.Repeat("x", size)}); err != nil {
+				return err
+			}
+			atomic.AddInt64(&sent, 1)
+		}
+		return nil
+	})
+
+	// Window sizes smaller than 64KB are ignored by grpc-go.
+	client := routeguide.NewRouteGuideClient(ts.Conn(grpc.WithInitialWindowSize(64*1024), grpc.WithInitialConnWindowSize(64*1024)))
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt64(&sent); got >= total {
+		t.Errorf("got %v\nwant less than %v while client is not reading", got, total)
+	}
+	c := 0
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+		c++
+	}
+	if c != total {
+		t.Errorf("got %v\nwant %v", c, total)
+	}
+}
+
+func TestServerStreamHandlerResponses(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("ListFeatures")
+	m.ServerStreamHandler(func(r *Request, s ServerStream) error {
+		for i := 0; i < 3; i++ {
+			if err := s.Send(Message{"name": fmt.Sprintf("feature[%d]", i)}); err != nil {
+				return err
+			}
+		}
+		return status.Error(codes.Aborted, "aborted")
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+
+	res := m.Responses()
+	if got, want := len(res), 1; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(res[0].Messages), 3; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := res[0].Status.Code(), codes.Aborted; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestServerStreamHandlerPanic(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	tb := &recordTB{}
+	ts.t = tb
+	m := ts.Method("ListFeatures")
+	m.ServerStreamHandler(func(r *Request, s ServerStream) error {
+		if err := s.Send(Message{"name": "first"}); err != nil {
+			return err
+		}
+		panic("broken")
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	s, _ := status.FromError(err)
+	if got, want := s.Code(), codes.Internal; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := s.Message(), "Internal: handler for routeguide.RouteGuide/ListFeatures panicked: broken"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := m.Responses()[0].Status.Code(), codes.Internal; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestServerStreamingResponseWriter(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	w := ts.Method("ListFeatures").ResponseWriter()
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first", "second"} {
+		if err := w.Send(Message{"name": name}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Name; got != name {
+			t.Errorf("got %v\nwant %v", got, name)
+		}
+	}
+	w.Close()
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v\nwant %v", err, io.EOF)
+	}
+	if err := w.Send(Message{"name": "closed"}); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestServerStreamingResponseWriterClientCanceled(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("ListFeatures")
+	w := m.ResponseWriter()
+	t.Cleanup(w.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Send(Message{"name": "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	for len(m.Responses()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The handler stops draining, so no streaming call receives the message.
+	sctx, scancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer scancel()
+	if err := w.SendContext(sctx, Message{"name": "second"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v\nwant %v", err, context.DeadlineExceeded)
+	}
+	if got, want := m.Responses()[0].Status.Code(), codes.Canceled; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestServerStreamingMaxInFlight(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	const (
+		total = 5
+		n     = 2
+	)
+	var sent int64
+	ts.Method("ListFeatures").MaxInFlight(n).ServerStreamHandler(func(r *Request, s ServerStream) error {
+		for i := 0; i < total; i++ {
+			if err := s.Send(Message{"name": fmt.Sprintf("%d", i)}); err != nil {
+				return err
+			}
+			atomic.AddInt64(&sent, 1)
+		}
+		return nil
+	})
+	waitSent := func(want int64) {
+		t.Helper()
+		for i := 0; i < 100 && atomic.LoadInt64(&sent) < want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// Wait more to check that no more messages are sent.
+		time.Sleep(50 * time.Millisecond)
+		if got := atomic.LoadInt64(&sent); got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSent(n)
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	waitSent(n + 1)
+	c := 1
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+		c++
+	}
+	if c != total {
+		t.Errorf("got %v\nwant %v", c, total)
+	}
+	if got := ts.Requests()[0].Headers.Get(inFlightStreamIDKey); len(got) != 0 {
+		t.Errorf("got %v\nwant no header", got)
+	}
+}
+
+func TestServerStreamingMaxInFlightResponse(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").MaxInFlight(1).Response(map[string]any{"name": "a"}).Response(map[string]any{"name": "b"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+		got = append(got, res.Name)
+	}
+	if diff := cmp.Diff(got, []string{"a", "b"}); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestServerStreamingMaxInFlightNotSet(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu      sync.Mutex
+		headers []string
+	)
+	ts := NewServer(t, "testdata/route_guide.proto", ServerOption(
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			md, _ := metadata.FromIncomingContext(ss.Context())
+			mu.Lock()
+			headers = append(headers, md.Get(inFlightStreamIDKey)...)
+			mu.Unlock()
+			return handler(srv, ss)
+		}),
+	))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(headers) != 0 {
+		t.Errorf("got %v\nwant no header", headers)
+	}
+}
+
+func TestServerStreamingMaxInFlightOtherClient(t *testing.T) {
+	ctx := context.Background()
+	tb := &recordTB{}
+	ts := NewServer(tb, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("ListFeatures").MaxInFlight(1).Response(map[string]any{"name": "a"}).Response(map[string]any{"name": "b"})
+
+	cc, err := grpc.Dial(ts.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cc.Close()
+	})
+	stream, err := routeguide.NewRouteGuideClient(cc).ListFeatures(ctx, &routeguide.Rectangle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := 0
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+		c++
+	}
+	if got, want := c, 2; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
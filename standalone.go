@@ -0,0 +1,46 @@
+package grpcstub
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+var _ TB = (*logTB)(nil)
+
+// logTB is TB which reports errors to *log.Logger for servers running outside tests.
+type logTB struct {
+	l *log.Logger
+}
+
+func (t *logTB) Error(args ...any) {
+	t.l.Print(args...)
+}
+
+func (t *logTB) Errorf(format string, args ...any) {
+	t.l.Printf(format, args...)
+}
+
+// Fatal reports args and panics because there is no test to stop.
+func (t *logTB) Fatal(args ...any) {
+	t.l.Panic(args...)
+}
+
+// Fatalf reports the formatted message and panics because there is no test to stop.
+func (t *logTB) Fatalf(format string, args ...any) {
+	t.l.Panicf(format, args...)
+}
+
+func (t *logTB) Helper() {}
+
+// NewStandaloneServer returns a new server with registered *grpc.Server for use outside tests ( e.g. a local mock server process ).
+// Errors while starting the server are returned, and errors while serving are reported to log.Default().
+// Fatal errors such as invalid matcher settings cause a panic.
+// The server is shut down when ctx is done.
+func NewStandaloneServer(ctx context.Context, protopath string, opts ...Option) (*Server, error) {
+	s, err := newServer(ctx, &logTB{l: log.Default()}, protopath, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,57 @@
+package grpcstub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k1LoW/grpcstub/testdata/routeguide"
+)
+
+func TestNewStandaloneServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts, err := NewStandaloneServer(ctx, "testdata/route_guide.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	cc, err := ts.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	res, err := routeguide.NewRouteGuideClient(cc).GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "hello"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	cancel()
+	select {
+	case <-ts.done:
+	case <-time.After(time.Second):
+		t.Fatal("want server to be shut down")
+	}
+}
+
+func TestNewStandaloneServerError(t *testing.T) {
+	tests := []struct {
+		name      string
+		protopath string
+		opts      []Option
+	}{
+		{"proto not found", "testdata/not_found.proto", nil},
+		{"invalid option", "testdata/route_guide.proto", []Option{UseTLS(nil, []byte("invalid"), []byte("invalid"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := NewStandaloneServer(context.Background(), tt.protopath, tt.opts...)
+			if err == nil {
+				ts.Close()
+				t.Fatal("want error")
+			}
+		})
+	}
+}
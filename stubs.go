@@ -0,0 +1,197 @@
+package grpcstub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// stubsConfig is the config file loaded by LoadStubs.
+type stubsConfig struct {
+	Stubs []stubConfig `json:"stubs"`
+}
+
+type stubConfig struct {
+	Service  string             `json:"service"`
+	Method   string             `json:"method"`
+	Priority int                `json:"priority"`
+	Match    stubMatchConfig    `json:"match"`
+	Response stubResponseConfig `json:"response"`
+}
+
+type stubMatchConfig struct {
+	Headers map[string]string `json:"headers"`
+	Message map[string]any    `json:"message"`
+}
+
+type stubResponseConfig struct {
+	Headers  map[string]string `json:"headers"`
+	Trailers map[string]string `json:"trailers"`
+	Message  map[string]any    `json:"message"`
+	Messages []map[string]any  `json:"messages"`
+	Status   *stubStatusConfig `json:"status"`
+}
+
+type stubStatusConfig struct {
+	// Code is the name ( e.g. "NOT_FOUND" ) or the number of codes.Code.
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message"`
+}
+
+// LoadStubs registers matchers and responses defined in the YAML or JSON file of path.
+//
+//	stubs:
+//	  - service: routeguide.RouteGuide
+//	    method: GetFeature
+//	    match:
+//	      headers:
+//	        authorization: Bearer token
+//	      message:
+//	        latitude: 10
+//	    response:
+//	      headers:
+//	        hello: header
+//	      message:
+//	        name: hello
+//	  - method: ListFeatures
+//	    response:
+//	      status:
+//	        code: NOT_FOUND
+//	        message: not found
+//
+// The match message is compared with Request.Message, and only the fields in the match message are compared.
+// Unknown keys, and services or methods that are not registered in the server, are reported as the error.
+// No stubs are registered unless all stubs in the file are valid.
+func (s *Server) LoadStubs(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// YAML is a superset of JSON, so both are decoded by yaml and then converted via JSON.
+	var v any
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("failed to load stubs %s: %w", path, err)
+	}
+	jb, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to load stubs %s: %w", path, err)
+	}
+	c := stubsConfig{}
+	dec := json.NewDecoder(bytes.NewReader(jb))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return fmt.Errorf("failed to load stubs %s: %w", path, err)
+	}
+	for i, sc := range c.Stubs {
+		if err := s.validateStub(sc); err != nil {
+			return fmt.Errorf("failed to load stubs %s: stubs[%d]: %w", path, i, err)
+		}
+	}
+	for _, sc := range c.Stubs {
+		s.registerStub(sc)
+	}
+	return nil
+}
+
+func (s *Server) validateStub(sc stubConfig) error {
+	if sc.Response.Message != nil && sc.Response.Messages != nil {
+		return errors.New("response message and messages cannot be set at the same time")
+	}
+	switch {
+	case sc.Service != "" && sc.Method != "":
+		if err := s.serviceError(sc.Service); err != nil {
+			return err
+		}
+		method := sc.Method
+		if !strings.Contains(method, "/") {
+			method = fmt.Sprintf("%s/%s", strings.TrimPrefix(sc.Service, "/"), method)
+		}
+		return s.methodError(method)
+	case sc.Service != "":
+		return s.serviceError(sc.Service)
+	case sc.Method != "":
+		return s.methodError(sc.Method)
+	default:
+		return errors.New("service or method is required")
+	}
+}
+
+// registerStub registers the stub validated by validateStub.
+func (s *Server) registerStub(sc stubConfig) {
+	var m *matcher
+	switch {
+	case sc.Service != "" && sc.Method != "":
+		m = s.Service(sc.Service).Method(sc.Method)
+	case sc.Service != "":
+		m = s.Service(sc.Service)
+	default:
+		m = s.Method(sc.Method)
+	}
+	m.Priority(sc.Priority)
+	if len(sc.Match.Headers) > 0 {
+		headers := sc.Match.Headers
+		m.Match(func(r *Request) bool {
+		L:
+			for k, v := range headers {
+				for _, got := range r.Headers.Get(k) {
+					if got == v {
+						continue L
+					}
+				}
+				return false
+			}
+			return true
+		})
+	}
+	if sc.Match.Message != nil {
+		want := sc.Match.Message
+		m.Match(func(r *Request) bool {
+			return containsMessage(r.Message, want)
+		})
+	}
+	for k, v := range sc.Response.Headers {
+		m.Header(k, v)
+	}
+	for k, v := range sc.Response.Trailers {
+		m.Trailer(k, v)
+	}
+	if sc.Response.Message != nil {
+		m.Response(sc.Response.Message)
+	}
+	for _, msg := range sc.Response.Messages {
+		m.Response(msg)
+	}
+	if sc.Response.Status != nil {
+		m.Status(status.New(sc.Response.Status.Code, sc.Response.Status.Message))
+	}
+}
+
+// containsMessage reports whether got contains all fields of want.
+func containsMessage(got, want map[string]any) bool {
+	for k, wv := range want {
+		gv, ok := got[k]
+		if !ok {
+			return false
+		}
+		wm, ok := wv.(map[string]any)
+		if !ok {
+			if !reflect.DeepEqual(gv, wv) {
+				return false
+			}
+			continue
+		}
+		gm, ok := gv.(map[string]any)
+		if !ok || !containsMessage(gm, wm) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package grpcstub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadStubs(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	if err := ts.LoadStubs("testdata/stubs/route_guide.yml"); err != nil {
+		t.Fatal(err)
+	}
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+
+	t.Run("matched", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token")
+		var header metadata.MD
+		res, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 10}, grpc.Header(&header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.Name, "hello"; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := res.Location.Latitude, int32(10); got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		if got, want := header.Get("hello"), []string{"header"}; !cmp.Equal(got, want) {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		tests := []struct {
+			name string
+			ctx  context.Context
+			req  *routeguide.Point
+		}{
+			{"header mismatch", context.Background(), &routeguide.Point{Latitude: 10}},
+			{"message mismatch", metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token"), &routeguide.Point{Latitude: 1}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := client.GetFeature(tt.ctx, tt.req)
+				s, _ := status.FromError(err)
+				if got, want := s.Code(), codes.NotFound; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+				if got, want := s.Message(), "not found"; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+			})
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		stream, err := client.ListFeatures(context.Background(), &routeguide.Rectangle{Lo: &routeguide.Point{Latitude: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			res, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, res.Name)
+		}
+		if want := []string{"first", "second"}; !cmp.Equal(got, want) {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	})
+}
+
+func TestLoadStubsJSON(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	if err := ts.LoadStubs("testdata/stubs/route_guide.json"); err != nil {
+		t.Fatal(err)
+	}
+	var trailer metadata.MD
+	res, err := routeguide.NewRouteGuideClient(ts.Conn()).GetFeature(context.Background(), &routeguide.Point{}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "json"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := trailer.Get("hello"), []string{"trailer"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestLoadStubsError(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"not found", "testdata/stubs/not_found.yml"},
+		{"no service and method", "testdata/stubs/invalid.yml"},
+		{"unknown field", "testdata/stubs/unknown_field.yml"},
+		{"unknown method", "testdata/stubs/unknown_method.yml"},
+		{"unknown service", "testdata/stubs/unknown_service.yml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := &recordTB{}
+			ts := NewServer(tb, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			if err := ts.LoadStubs(tt.path); err == nil {
+				t.Error("want error")
+			}
+			if got := len(tb.errors); got != 0 {
+				t.Errorf("got %v\nwant %v", got, 0)
+			}
+			ts.mu.RLock()
+			got := len(ts.matchers)
+			ts.mu.RUnlock()
+			if got != 0 {
+				t.Errorf("got %v\nwant %v", got, 0)
+			}
+		})
+	}
+}
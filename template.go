@@ -0,0 +1,210 @@
+package grpcstub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const templateJSONFunc = "__grpcstub_json"
+
+// ResponseTemplate set handler which return response rendered from tmpl per request.
+// String values containing `{{` are executed as text/template with the *Request as data ( e.g. "{{ .Message.name }}" ).
+// If a string value consists of a single action, the value keeps the type of the result ( e.g. number, bool and map ), otherwise it is rendered as string.
+// Numbers and bools rendered into string fields are converted to strings.
+// If the execution fails, it reports the test error and returns Internal.
+func (m *matcher) ResponseTemplate(tmpl map[string]any) *matcher {
+	// Normalize nested values ( e.g. []Message ) into map[string]any and []any.
+	b, err := json.Marshal(tmpl)
+	if err != nil {
+		m.t.Fatalf("failed to parse response template: %v", err)
+		return m
+	}
+	var normalized any
+	if err := json.Unmarshal(b, &normalized); err != nil {
+		m.t.Fatalf("failed to parse response template: %v", err)
+		return m
+	}
+	rt, err := parseResponseTemplate(normalized)
+	if err != nil {
+		m.t.Fatalf("failed to parse response template: %v", err)
+		return m
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.handler
+	m.handler = func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		var res *Response
+		if prev == nil {
+			res = NewResponse()
+		} else {
+			res = prev(r, md)
+		}
+		v, err := rt.render(r)
+		if err != nil {
+			m.t.Errorf("failed to render response template: %v", err)
+			res.Status = status.Newf(codes.Internal, "%s: failed to render response template: %v", codes.Internal.String(), err)
+			return res
+		}
+		mes := v.(map[string]any)
+		coerceStrings(mes, md.Output())
+		res.Messages = append(res.Messages, mes)
+		return res
+	}
+	return m
+}
+
+// coerceStrings converts numbers and bools rendered into string fields of d to strings, because protojson does not accept them.
+func coerceStrings(m map[string]any, d protoreflect.MessageDescriptor) {
+	for k, v := range m {
+		fd := d.Fields().ByName(protoreflect.Name(k))
+		if fd == nil {
+			fd = d.Fields().ByJSONName(k)
+		}
+		if fd == nil || fd.IsMap() {
+			continue
+		}
+		if fd.IsList() {
+			l, ok := v.([]any)
+			if !ok {
+				continue
+			}
+			for i, e := range l {
+				l[i] = coerceString(e, fd)
+			}
+			continue
+		}
+		m[k] = coerceString(v, fd)
+	}
+}
+
+func coerceString(v any, fd protoreflect.FieldDescriptor) any {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		switch vv := v.(type) {
+		case float64, bool:
+			k, _ := fieldKey(vv)
+			return k
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if mm, ok := v.(map[string]any); ok {
+			coerceStrings(mm, fd.Message())
+		}
+	}
+	return v
+}
+
+// responseTemplate is the parsed value of the template given to ResponseTemplate.
+type responseTemplate struct {
+	tmpl *template.Template
+	// typed is true if the template consists of a single action, so the result is decoded as JSON to keep its type.
+	typed bool
+	m     map[string]*responseTemplate
+	l     []*responseTemplate
+	v     any
+}
+
+func parseResponseTemplate(v any) (*responseTemplate, error) {
+	switch vv := v.(type) {
+	case map[string]any:
+		rt := &responseTemplate{m: map[string]*responseTemplate{}}
+		for k, e := range vv {
+			c, err := parseResponseTemplate(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			rt.m[k] = c
+		}
+		return rt, nil
+	case []any:
+		rt := &responseTemplate{l: []*responseTemplate{}}
+		for i, e := range vv {
+			c, err := parseResponseTemplate(e)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			rt.l = append(rt.l, c)
+		}
+		return rt, nil
+	case string:
+		if !strings.Contains(vv, "{{") {
+			return &responseTemplate{v: vv}, nil
+		}
+		funcs := template.FuncMap{templateJSONFunc: templateJSON}
+		t, err := template.New("").Funcs(funcs).Parse(vv)
+		if err != nil {
+			return nil, err
+		}
+		nodes := t.Tree.Root.Nodes
+		if len(nodes) != 1 {
+			return &responseTemplate{tmpl: t}, nil
+		}
+		a, ok := nodes[0].(*parse.ActionNode)
+		if !ok || len(a.Pipe.Decl) > 0 {
+			return &responseTemplate{tmpl: t}, nil
+		}
+		// Wrap the pipeline to get the result as JSON instead of the string representation.
+		typed, err := template.New("").Funcs(funcs).Parse(fmt.Sprintf("{{ %s (%s) }}", templateJSONFunc, a.Pipe.String()))
+		if err != nil {
+			return nil, err
+		}
+		return &responseTemplate{tmpl: typed, typed: true}, nil
+	default:
+		return &responseTemplate{v: vv}, nil
+	}
+}
+
+func (rt *responseTemplate) render(r *Request) (any, error) {
+	switch {
+	case rt.m != nil:
+		out := map[string]any{}
+		for k, c := range rt.m {
+			v, err := c.render(r)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = v
+		}
+		return out, nil
+	case rt.l != nil:
+		out := []any{}
+		for i, c := range rt.l {
+			v, err := c.render(r)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case rt.tmpl != nil:
+		buf := new(bytes.Buffer)
+		if err := rt.tmpl.Execute(buf, r); err != nil {
+			return nil, err
+		}
+		if !rt.typed {
+			return buf.String(), nil
+		}
+		var v any
+		if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	default:
+		return rt.v, nil
+	}
+}
+
+func templateJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
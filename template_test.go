@@ -0,0 +1,99 @@
+package grpcstub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResponseTemplate(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("GetFeature").ResponseTemplate(map[string]any{
+		"name": "feature at {{ .Message.latitude }},{{ .Message.longitude }} via {{ .Method }}",
+		"location": map[string]any{
+			"latitude":  "{{ .Message.latitude }}",
+			"longitude": 100,
+		},
+	})
+	ts.Method("ListFeatures").ResponseTemplate(map[string]any{
+		"name":     "{{ .Message.lo.latitude }}",
+		"location": "{{ .Message.hi }}",
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 10, Longitude: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "feature at 10,20 via GetFeature"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := res.Location.Latitude, int32(10); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := res.Location.Longitude, int32(100); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	// The value of a single action keeps the type of the result.
+	want := map[string]any{"latitude": float64(10), "longitude": float64(100)}
+	if diff := cmp.Diff(m.Responses()[0].Messages[0]["location"], any(want)); diff != "" {
+		t.Error(diff)
+	}
+
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{Lo: &routeguide.Point{Latitude: 1}, Hi: &routeguide.Point{Latitude: 2, Longitude: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Name, "1"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := f.Location.Longitude, int32(3); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestResponseTemplateInvalid(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	tb := &recordTB{}
+	m := ts.Method("GetFeature")
+	m.t = tb
+	m.ResponseTemplate(map[string]any{"name": "{{ .Message.latitude"})
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestResponseTemplateExecutionError(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	tb := &recordTB{}
+	m := ts.Method("GetFeature")
+	m.t = tb
+	m.ResponseTemplate(map[string]any{"name": "{{ .Unknown }}"})
+
+	_, err := routeguide.NewRouteGuideClient(ts.Conn()).GetFeature(ctx, &routeguide.Point{})
+	if got, want := status.Code(err), codes.Internal; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
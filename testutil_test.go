@@ -0,0 +1,77 @@
+package grpcstub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var _ TB = (*recordTB)(nil)
+
+// recordTB is a TB which records errors instead of failing the test.
+type recordTB struct {
+	errors []string
+	fatals []string
+	mu     sync.Mutex
+}
+
+func (tb *recordTB) Error(args ...any) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.errors = append(tb.errors, fmt.Sprint(args...))
+}
+
+func (tb *recordTB) Errorf(format string, args ...any) {
+	tb.Error(fmt.Sprintf(format, args...))
+}
+
+func (tb *recordTB) Fatal(args ...any) {
+	tb.Error(args...)
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.fatals = append(tb.fatals, fmt.Sprint(args...))
+}
+
+func (tb *recordTB) Fatalf(format string, args ...any) {
+	tb.Fatal(fmt.Sprintf(format, args...))
+}
+
+func (tb *recordTB) Helper() {}
+
+// invoke calls the unary method of the server with the request message in JSON using dynamicpb.
+func invoke(t *testing.T, ts *Server, method string, req string) (map[string]any, error) {
+	t.Helper()
+	r := ts.fds.AsResolver()
+	d, err := r.FindDescriptorByName(protoreflect.FullName(strings.ReplaceAll(strings.TrimPrefix(method, "/"), "/", ".")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		t.Fatalf("%s is not method", method)
+	}
+	in := dynamicpb.NewMessage(md.Input())
+	if err := protojson.Unmarshal([]byte(req), in); err != nil {
+		t.Fatal(err)
+	}
+	out := dynamicpb.NewMessage(md.Output())
+	if err := ts.Conn().Invoke(context.Background(), method, in, out); err != nil {
+		return nil, err
+	}
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]any{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res, nil
+}
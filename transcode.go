@@ -0,0 +1,165 @@
+package grpcstub
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// JSONHandler returns http.Handler which serves unary methods at POST /{package.Service}/{Method} with JSON request and response bodies.
+// Response headers and trailers are sent as HTTP headers and trailers, and the status is mapped to the HTTP status code with the JSON body of google.rpc.Status.
+// Interceptors set by ServerOption are not called.
+func (s *Server) JSONHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, fmt.Sprintf("invalid request method %q", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		md, err := s.findUnaryMethod(r.URL.Path)
+		if err != nil {
+			writeJSONError(w, status.Convert(err))
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, status.New(codes.Internal, err.Error()))
+			return
+		}
+		in := dynamicpb.NewMessage(md.Input())
+		if len(b) > 0 {
+			if err := protojson.Unmarshal(b, in); err != nil {
+				writeJSONError(w, status.New(codes.InvalidArgument, err.Error()))
+				return
+			}
+		}
+		headers := metadata.MD{}
+		for k, v := range r.Header {
+			headers.Append(k, v...)
+		}
+		ts := &jsonTransportStream{method: r.URL.Path, header: metadata.MD{}, trailer: metadata.MD{}}
+		ctx := grpc.NewContextWithServerTransportStream(metadata.NewIncomingContext(r.Context(), headers), ts)
+		res, err := s.handleUnary(ctx, md, in)
+		h := w.Header()
+		for k, v := range ts.header {
+			for _, vv := range v {
+				h.Add(k, vv)
+			}
+		}
+		for k, v := range ts.trailer {
+			for _, vv := range v {
+				h.Add(http.TrailerPrefix+k, vv)
+			}
+		}
+		if err != nil {
+			writeJSONError(w, status.Convert(err))
+			return
+		}
+		out, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(res.(proto.Message))
+		if err != nil {
+			writeJSONError(w, status.New(codes.Internal, err.Error()))
+			return
+		}
+		h.Set("Content-Type", "application/json")
+		_, _ = w.Write(out)
+	})
+}
+
+func (s *Server) findUnaryMethod(path string) (protoreflect.MethodDescriptor, error) {
+	fullname := strings.TrimPrefix(path, "/")
+	i := strings.LastIndex(fullname, "/")
+	if i < 0 {
+		return nil, status.Errorf(codes.NotFound, "%s: invalid path %s", codes.NotFound.String(), path)
+	}
+	d, err := s.fds.AsResolver().FindDescriptorByName(protoreflect.FullName(fullname[:i] + "." + fullname[i+1:]))
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "%s: method not found %s", codes.NotFound.String(), path)
+	}
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s: method not found %s", codes.NotFound.String(), path)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, status.Errorf(codes.Unimplemented, "%s: streaming method %s is not supported", codes.Unimplemented.String(), path)
+	}
+	return md, nil
+}
+
+func writeJSONError(w http.ResponseWriter, st *status.Status) {
+	b, err := protojson.Marshal(st.Proto())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	_, _ = w.Write(b)
+}
+
+// httpStatusFromCode returns the HTTP status code corresponding to code.
+// See https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+var _ grpc.ServerTransportStream = (*jsonTransportStream)(nil)
+
+// jsonTransportStream is grpc.ServerTransportStream which collects headers and trailers set by the handlers.
+type jsonTransportStream struct {
+	method  string
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+func (ts *jsonTransportStream) Method() string {
+	return ts.method
+}
+
+func (ts *jsonTransportStream) SetHeader(md metadata.MD) error {
+	ts.header = metadata.Join(ts.header, md)
+	return nil
+}
+
+func (ts *jsonTransportStream) SendHeader(md metadata.MD) error {
+	return ts.SetHeader(md)
+}
+
+func (ts *jsonTransportStream) SetTrailer(md metadata.MD) error {
+	ts.trailer = metadata.Join(ts.trailer, md)
+	return nil
+}
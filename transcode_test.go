@@ -0,0 +1,84 @@
+package grpcstub
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+)
+
+func TestJSONHandler(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Match(func(r *Request) bool {
+		return r.Message["latitude"] == float64(10)
+	}).Header("hello", "header").Response(map[string]any{"name": "hello"})
+	ts.Method("GetFeature").StatusCode(codes.PermissionDenied, "denied")
+	hs := httptest.NewServer(ts.JSONHandler())
+	t.Cleanup(func() {
+		hs.Close()
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   map[string]any
+	}{
+		{"ok", http.MethodPost, "/routeguide.RouteGuide/GetFeature", `{"latitude": 10}`, http.StatusOK, map[string]any{"name": "hello"}},
+		{"error status", http.MethodPost, "/routeguide.RouteGuide/GetFeature", `{"latitude": 1}`, http.StatusForbidden, map[string]any{"code": float64(codes.PermissionDenied), "message": "denied"}},
+		{"invalid json", http.MethodPost, "/routeguide.RouteGuide/GetFeature", `{"latitude": "x"}`, http.StatusBadRequest, nil},
+		{"method not found", http.MethodPost, "/routeguide.RouteGuide/Unknown", `{}`, http.StatusNotFound, nil},
+		{"streaming method", http.MethodPost, "/routeguide.RouteGuide/ListFeatures", `{}`, http.StatusNotImplemented, nil},
+		{"invalid request method", http.MethodGet, "/routeguide.RouteGuide/GetFeature", ``, http.StatusMethodNotAllowed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, hs.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if got := res.StatusCode; got != tt.wantStatus {
+				t.Errorf("got %v\nwant %v", got, tt.wantStatus)
+			}
+			if tt.wantBody == nil {
+				return
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]any{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.wantBody); diff != "" {
+				t.Error(diff)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if got, want := res.Header.Get("hello"), "header"; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+			}
+		})
+	}
+
+	if got, want := ts.Requests()[0].Headers.Get("content-type"), []string{"application/json"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
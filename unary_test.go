@@ -2,9 +2,22 @@ package grpcstub
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/k1LoW/grpcstub/testdata/routeguide"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 func TestUnary(t *testing.T) {
@@ -87,3 +100,1048 @@ func TestUnaryUnmatched(t *testing.T) {
 		}
 	}
 }
+
+func TestUnaryUnmatchedUnimplemented(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	_, err := client.GetFeature(ctx, &routeguide.Point{})
+	s, ok := status.FromError(err)
+	if !ok {
+		t.Fatal("want status.Status")
+	}
+	if want := codes.Unimplemented; s.Code() != want {
+		t.Errorf("got %v\nwant %v", s.Code(), want)
+	}
+	if want := "routeguide.RouteGuide/GetFeature"; !strings.Contains(s.Message(), want) {
+		t.Errorf("got %v\nwant to contain %v", s.Message(), want)
+	}
+}
+
+func TestUnaryUnmatchedFallback(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Unmatched(func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		res := NewResponse()
+		res.Messages = append(res.Messages, Message{"name": string(md.Output().Name())})
+		return res
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Feature"; res.Name != want {
+		t.Errorf("got %v\nwant %v", res.Name, want)
+	}
+	{
+		got := len(ts.UnmatchedRequests())
+		if want := 1; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+}
+
+func TestAssertNoUnmatchedRequests(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	ts.AssertNoUnmatchedRequests(t)
+
+	ts.ClearMatchers()
+	_, _ = client.GetFeature(ctx, &routeguide.Point{})
+	tb := &recordTB{}
+	ts.AssertNoUnmatchedRequests(tb)
+	if got, want := len(tb.errors), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestUnaryResponseUnknownField(t *testing.T) {
+	tests := []struct {
+		name string
+		res  map[string]any
+		want string
+	}{
+		{"top level", map[string]any{"name": "hello", "unknown_field": "world"}, `unknown field "unknown_field"`},
+		{"nested", map[string]any{"name": "hello", "location": map[string]any{"lat": 10}}, `unknown field "lat"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tb := &recordTB{}
+			ts := NewServer(tb, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("GetFeature").Response(tt.res)
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			if _, err := client.GetFeature(ctx, &routeguide.Point{}); err == nil {
+				t.Error("want error")
+			}
+			if got, want := len(tb.errors), 1; got != want {
+				t.Fatalf("got %v\nwant %v", got, want)
+			}
+			for _, want := range []string{"routeguide.Feature", tt.want} {
+				if !strings.Contains(tb.errors[0], want) {
+					t.Errorf("got %v\nwant to contain %v", tb.errors[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnaryResponsePresence(t *testing.T) {
+	tests := []struct {
+		name string
+		res  any
+		want map[string]any
+	}{
+		{"omitted", map[string]any{}, map[string]any{}},
+		{"null", map[string]any{"count": nil, "name": nil}, map[string]any{}},
+		{"explicit zero", map[string]any{"count": 0, "name": ""}, map[string]any{"count": float64(0), "name": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/presence.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("Get").Response(tt.res)
+			got, err := invoke(t, ts, "/presence.PresenceService/Get", `{}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestUnaryResponsePresenceProtoMessage(t *testing.T) {
+	ts := NewServer(t, "testdata/presence.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	d, err := ts.fds.AsResolver().FindMessageByName("presence.GetResponse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mes := dynamicpb.NewMessage(d.Descriptor())
+	if err := protojson.Unmarshal([]byte(`{"count": 0}`), mes); err != nil {
+		t.Fatal(err)
+	}
+	ts.Method("Get").Response(mes)
+	got, err := invoke(t, ts, "/presence.PresenceService/Get", `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, map[string]any{"count": float64(0)}); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestUnaryResponseTable(t *testing.T) {
+	tests := []struct {
+		name     string
+		table    map[any]Message
+		latitude int32
+		want     string
+		wantCode codes.Code
+	}{
+		{"int key", map[any]Message{1: {"name": "one"}, int32(2): {"name": "two"}}, 2, "two", codes.OK},
+		{"float key", map[any]Message{1.0: {"name": "one"}}, 1, "one", codes.OK},
+		{"no row", map[any]Message{1: {"name": "one"}}, 3, "", codes.NotFound},
+		{"default row", map[any]Message{1: {"name": "one"}, nil: {"name": "default"}}, 3, "default", codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("GetFeature").ResponseTable("latitude", tt.table)
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			res, err := client.GetFeature(ctx, &routeguide.Point{Latitude: tt.latitude})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("got %v\nwant %v", got, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if got := res.Name; got != tt.want {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnaryResponseTableInt64(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"string", nil},
+		{"Int64AsNumber", []Option{Int64AsNumber()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/hello.proto", tt.opts...)
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			// Keys above 2^53 collide if they are compared as float64.
+			ts.Method("Hello").ResponseTable("num", map[any]Message{
+				int64(9007199254740992): {"message": "even"},
+				int64(9007199254740993): {"message": "odd"},
+			})
+			ts.Method("Hello").ResponseByField("num", map[string]Message{
+				"9007199254740993": {"message": "odd"},
+			})
+			for _, req := range []string{`{"num": "9007199254740992"}`, `{"num": "9007199254740993"}`} {
+				got, err := invoke(t, ts, "/hello.GrpcTestService/Hello", req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := "even"
+				if strings.HasSuffix(req, `3"}`) {
+					want = "odd"
+				}
+				if got["message"] != want {
+					t.Errorf("got %v\nwant %v", got["message"], want)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseTableNotScalar(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(m *matcher)
+	}{
+		{"ResponseTable", func(m *matcher) {
+			m.ResponseTable("lo", map[any]Message{1: {"name": "one"}, nil: {"name": "default"}})
+		}},
+		{"ResponseByField", func(m *matcher) {
+			m.ResponseByField("lo", map[string]Message{"1": {"name": "one"}, "*": {"name": "default"}})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			tt.setup(ts.Method("ListFeatures"))
+			stream, err := routeguide.NewRouteGuideClient(ts.Conn()).ListFeatures(ctx, &routeguide.Rectangle{Lo: &routeguide.Point{Latitude: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := res.Name, "default"; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestUnaryRequireHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		md         metadata.MD
+		wantCode   codes.Code
+		wantErrors int
+	}{
+		{"with header", metadata.Pairs("authorization", "Bearer token"), codes.OK, 0},
+		{"without header", metadata.MD{}, codes.Unauthenticated, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			tb := &recordTB{}
+			m := ts.Method("GetFeature")
+			m.t = tb
+			m.RequireHeader("Authorization").Response(map[string]any{"name": "hello"})
+
+			ctx := metadata.NewOutgoingContext(context.Background(), tt.md)
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			_, err := client.GetFeature(ctx, &routeguide.Point{})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("got %v\nwant %v", got, tt.wantCode)
+			}
+			if got := len(tb.errors); got != tt.wantErrors {
+				t.Errorf("got %v\nwant %v", got, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestUnaryHandlerContext(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").HandlerContext(func(ctx context.Context, r *Request) *Response {
+		res := NewResponse()
+		if _, ok := ctx.Deadline(); ok {
+			res.Messages = append(res.Messages, map[string]any{"name": "with deadline"})
+		}
+		return res
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	res, err := client.GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "with deadline"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestUnaryHangUntilDeadlineExceeded(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").HangUntilDeadlineExceeded()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	_, err := client.GetFeature(ctx, &routeguide.Point{})
+	if got, want := status.Code(err), codes.DeadlineExceeded; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := len(ts.Requests()), 1; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestUnaryResponseProto(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        proto.Message
+		wantCode   codes.Code
+		wantErrors int
+	}{
+		{"match", &routeguide.Feature{Name: "hello"}, codes.OK, 0},
+		{"mismatch", &routeguide.Point{Latitude: 1}, codes.Internal, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			tb := &recordTB{}
+			m := ts.Method("GetFeature")
+			m.t = tb
+			m.ResponseProto(tt.msg)
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			res, err := client.GetFeature(context.Background(), &routeguide.Point{})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("got %v\nwant %v", got, tt.wantCode)
+			}
+			if got := len(tb.errors); got != tt.wantErrors {
+				t.Errorf("got %v\nwant %v", got, tt.wantErrors)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := res.Name, "hello"; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRequestAs(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(context.Background(), &routeguide.Point{Latitude: 10, Longitude: 13}); err != nil {
+		t.Fatal(err)
+	}
+	r := ts.Requests()[0]
+	var p routeguide.Point
+	if err := r.As(&p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Latitude, int32(10); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if got, want := p.Longitude, int32(13); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+
+	var f routeguide.Rectangle
+	if err := r.As(&f); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestUnaryResponseByField(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").ResponseByField("latitude", map[string]Message{
+		"1": {"name": "one"},
+		"2": {"name": "two"},
+		"*": {"name": "default"},
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		latitude int32
+		want     string
+	}{
+		{1, "one"},
+		{2, "two"},
+		{3, "default"},
+	}
+	var wg sync.WaitGroup
+	for _, tt := range tests {
+		tt := tt
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.GetFeature(context.Background(), &routeguide.Point{Latitude: tt.latitude})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := res.Name; got != tt.want {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUnaryResponseByFieldNotFound(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").ResponseByField("latitude", map[string]Message{
+		"1": {"name": "one"},
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	_, err := client.GetFeature(context.Background(), &routeguide.Point{Latitude: 2})
+	if got, want := status.Code(err), codes.NotFound; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestRequestRaw(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	want := &routeguide.Point{Latitude: 10, Longitude: 13}
+	if _, err := client.GetFeature(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+	got := &routeguide.Point{}
+	if err := proto.Unmarshal(ts.Requests()[0].Raw, got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestUnaryResponseSequence(t *testing.T) {
+	tests := []struct {
+		name       string
+		repeatLast bool
+		want       []string
+		wantCode   codes.Code
+	}{
+		{"exhausted", false, []string{"first", "second"}, codes.ResourceExhausted},
+		{"repeat last", true, []string{"first", "second", "second"}, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			messages := []Message{{"name": "first"}, {"name": "second"}}
+			if tt.repeatLast {
+				ts.Method("GetFeature").ResponseSequenceRepeatLast(messages...)
+			} else {
+				ts.Method("GetFeature").ResponseSequence(messages...)
+			}
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			for _, want := range tt.want {
+				res, err := client.GetFeature(context.Background(), &routeguide.Point{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := res.Name; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+			}
+			_, err := client.GetFeature(context.Background(), &routeguide.Point{})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("got %v\nwant %v", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestUnaryResponseSequenceConcurrent(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	const n = 10
+	var messages []Message
+	for i := 0; i < n; i++ {
+		messages = append(messages, Message{"name": fmt.Sprintf("%d", i)})
+	}
+	ts.Method("GetFeature").ResponseSequence(messages...)
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	var (
+		mu  sync.Mutex
+		got = map[string]struct{}{}
+		wg  sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.GetFeature(context.Background(), &routeguide.Point{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			got[res.Name] = struct{}{}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(got) != n {
+		t.Errorf("got %v\nwant %v", len(got), n)
+	}
+}
+
+func TestUnaryFlaky(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     float64
+		check func(t *testing.T, failed int, n int)
+	}{
+		{"never", 0, func(t *testing.T, failed, n int) {
+			if failed != 0 {
+				t.Errorf("got %v\nwant %v", failed, 0)
+			}
+		}},
+		{"always", 1, func(t *testing.T, failed, n int) {
+			if failed != n {
+				t.Errorf("got %v\nwant %v", failed, n)
+			}
+		}},
+		{"sometimes", 0.5, func(t *testing.T, failed, n int) {
+			if failed == 0 || failed == n {
+				t.Errorf("got %v\nwant between 0 and %v", failed, n)
+			}
+		}},
+	}
+	const n = 20
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/route_guide.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("GetFeature").FlakySeed(1).Flaky(tt.p, status.New(codes.Unavailable, "unavailable")).Response(map[string]any{"name": "hello"})
+
+			client := routeguide.NewRouteGuideClient(ts.Conn())
+			failed := 0
+			for i := 0; i < n; i++ {
+				res, err := client.GetFeature(context.Background(), &routeguide.Point{})
+				if err != nil {
+					if got, want := status.Code(err), codes.Unavailable; got != want {
+						t.Errorf("got %v\nwant %v", got, want)
+					}
+					failed++
+					continue
+				}
+				if got, want := res.Name, "hello"; got != want {
+					t.Errorf("got %v\nwant %v", got, want)
+				}
+			}
+			tt.check(t, failed, n)
+		})
+	}
+}
+
+func TestUnaryFlakySeed(t *testing.T) {
+	results := func() []codes.Code {
+		ts := NewServer(t, "testdata/route_guide.proto")
+		t.Cleanup(func() {
+			ts.Close()
+		})
+		ts.Method("GetFeature").FlakySeed(42).Flaky(0.5, status.New(codes.Unavailable, "unavailable")).Response(map[string]any{"name": "hello"})
+		client := routeguide.NewRouteGuideClient(ts.Conn())
+		var got []codes.Code
+		for i := 0; i < 20; i++ {
+			_, err := client.GetFeature(context.Background(), &routeguide.Point{})
+			got = append(got, status.Code(err))
+		}
+		return got
+	}
+	if diff := cmp.Diff(results(), results()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestUnaryResponses(t *testing.T) {
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("GetFeature").ResponseSequence(Message{"name": "first"}, Message{"name": "second"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetFeature(context.Background(), &routeguide.Point{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := m.Responses()
+	if got, want := len(res), 2; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	for i, want := range []string{"first", "second"} {
+		if got := res[i].Messages[0]["name"]; got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+}
+
+func TestUnaryResponseWellKnownTypes(t *testing.T) {
+	ts := NewServer(t, "testdata/wkt.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	want := map[string]any{
+		"time":     "2020-01-01T00:00:00Z",
+		"duration": "1.500s",
+		"attrs": map[string]any{
+			"name": "alice",
+			"tags": []any{"a", "b"},
+			"nested": map[string]any{
+				"n": float64(1),
+			},
+		},
+		"value": "hello",
+		"mask":  "name,nested.n",
+	}
+	ts.Method("Get").Response(want)
+	got, err := invoke(t, ts, "/wkt.WKTService/Get", `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestUnaryOneof(t *testing.T) {
+	tests := []struct {
+		name        string
+		req         string
+		wantMessage Message
+		want        map[string]any
+	}{
+		{"unset", `{}`, Message{}, map[string]any{}},
+		{"text", `{"text": "hello"}`, Message{"text": "hello"}, map[string]any{"text": "hello"}},
+		{"zero value of number", `{"number": 0}`, Message{"number": float64(0)}, map[string]any{"number": float64(0)}},
+		{"message", `{"image": {"url": "x"}}`, Message{"image": map[string]any{"url": "x"}}, map[string]any{"image": map[string]any{"url": "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/oneof.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			// Echo back the populated arm of the oneof.
+			ts.Method("Echo").Handler(func(r *Request) *Response {
+				res := NewResponse()
+				res.Messages = append(res.Messages, r.Message)
+				return res
+			})
+			got, err := invoke(t, ts, "/oneoftest.OneofService/Echo", tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(ts.Requests()[0].Message, tt.wantMessage); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestUnaryOneofMultipleArms(t *testing.T) {
+	ts := NewServer(t, "testdata/oneof.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	tb := &recordTB{}
+	ts.t = tb
+	ts.Method("Echo").Response(map[string]any{"text": "hello", "number": 1})
+	if _, err := invoke(t, ts, "/oneoftest.OneofService/Echo", `{}`); err == nil {
+		t.Error("want error")
+	}
+	if got, want := len(tb.errors), 1; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if want := "oneoftest.Content.body is already set"; !strings.Contains(tb.errors[0], want) {
+		t.Errorf("got %v\nwant to contain %v", tb.errors[0], want)
+	}
+}
+
+func TestUnaryResponseBytes(t *testing.T) {
+	raw := []byte{0x00, 0x01, 0xfe, 0xff}
+	b64 := base64.StdEncoding.EncodeToString(raw)
+	tests := []struct {
+		name string
+		res  map[string]any
+	}{
+		{"[]byte", map[string]any{"data": raw, "chunks": [][]byte{raw}, "named": map[string][]byte{"a": raw}}},
+		{"base64 string", map[string]any{"data": b64, "chunks": []string{b64}, "named": map[string]string{"a": b64}}},
+		{"base64url string", map[string]any{"data": base64.URLEncoding.EncodeToString(raw), "chunks": []string{b64}, "named": map[string]string{"a": b64}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/bytes.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("Echo").Response(tt.res)
+			got, err := invoke(t, ts, "/bytestest.BytesService/Echo", `{}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]any{"data": b64, "chunks": []any{b64}, "named": map[string]any{"a": b64}}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestUnaryMatchEnum(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		value string
+		req   string
+		want  string
+	}{
+		{"by name", "color", "COLOR_RED", `{"color": "COLOR_RED"}`, "matched"},
+		{"by number", "color", "1", `{"color": 1}`, "matched"},
+		{"zero value", "color", "COLOR_UNSPECIFIED", `{}`, "matched"},
+		{"not matched", "color", "COLOR_BLUE", `{"color": "COLOR_RED"}`, "default"},
+		{"repeated", "palette.1", "COLOR_BLUE", `{"palette": ["COLOR_RED", "COLOR_BLUE"]}`, "matched"},
+		{"nested", "brush.color", "COLOR_BLUE", `{"brush": {"color": "COLOR_BLUE"}}`, "matched"},
+		{"map", "layers.bg", "COLOR_RED", `{"layers": {"bg": "COLOR_RED"}}`, "matched"},
+		{"missing map key", "layers.fg", "COLOR_RED", `{"layers": {"bg": "COLOR_RED"}}`, "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewServer(t, "testdata/enum.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.Method("Paint").MatchEnum(tt.path, tt.value).Response(map[string]any{"result": "matched"})
+			ts.Method("Paint").Response(map[string]any{"result": "default"})
+			got, err := invoke(t, ts, "/enumtest.EnumService/Paint", tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["result"] != tt.want {
+				t.Errorf("got %v\nwant %v", got["result"], tt.want)
+			}
+		})
+	}
+}
+
+func TestUnaryMatchEnumWithEnumNames(t *testing.T) {
+	ts := NewServer(t, "testdata/enum.proto", RequestMarshalOptions(protojson.MarshalOptions{}))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("Paint").MatchEnum("brush.color", "2").Response(map[string]any{"result": "matched"})
+	ts.Method("Paint").Response(map[string]any{"result": "default"})
+	got, err := invoke(t, ts, "/enumtest.EnumService/Paint", `{"brush": {"color": "COLOR_BLUE"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["result"] != "matched" {
+		t.Errorf("got %v\nwant %v", got["result"], "matched")
+	}
+	if got, want := ts.Requests()[0].Message["brush"], map[string]any{"color": "COLOR_BLUE"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestUnaryMatchEnumInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		value string
+		want  string
+	}{
+		{"not enum field", "name", "COLOR_RED", "name is not enum field of any request message"},
+		{"unknown field", "colour", "COLOR_RED", "colour is not enum field of any request message"},
+		{"unknown value", "color", "COLOR_GREEN", "COLOR_GREEN is not value of enumtest.Color"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := &recordTB{}
+			ts := NewServer(tb, "testdata/enum.proto")
+			t.Cleanup(func() {
+				ts.Close()
+			})
+			ts.MatchEnum(tt.path, tt.value).Response(map[string]any{"result": "matched"})
+			ts.Method("Paint").Response(map[string]any{"result": "default"})
+			got, err := invoke(t, ts, "/enumtest.EnumService/Paint", `{"color": "COLOR_RED"}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["result"] != "default" {
+				t.Errorf("got %v\nwant %v", got["result"], "default")
+			}
+			if got, want := len(tb.errors), 1; got != want {
+				t.Fatalf("got %v\nwant %v", got, want)
+			}
+			if !strings.Contains(tb.errors[0], tt.want) {
+				t.Errorf("got %v\nwant to contain %v", tb.errors[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestUnaryValidateRequest(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	ts.Method("GetFeature").ValidateRequest(func(r *Request, md protoreflect.MethodDescriptor) error {
+		if r.Message["latitude"] == float64(0) {
+			return fmt.Errorf("%s.latitude is required", md.Input().FullName())
+		}
+		return nil
+	}).ValidateRequest(func(r *Request, md protoreflect.MethodDescriptor) error {
+		if r.Message["longitude"] == float64(-1) {
+			return status.Error(codes.OutOfRange, "longitude is out of range")
+		}
+		return nil
+	}).Response(map[string]any{"name": "hello"})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		name     string
+		req      *routeguide.Point
+		wantCode codes.Code
+		wantMsg  string
+	}{
+		{"valid", &routeguide.Point{Latitude: 1}, codes.OK, ""},
+		{"invalid", &routeguide.Point{}, codes.InvalidArgument, "routeguide.Point.latitude is required"},
+		{"status error", &routeguide.Point{Latitude: 1, Longitude: -1}, codes.OutOfRange, "longitude is out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.GetFeature(ctx, tt.req)
+			st := status.Convert(err)
+			if got := st.Code(); got != tt.wantCode {
+				t.Errorf("got %v\nwant %v", got, tt.wantCode)
+			}
+			if got := st.Message(); got != tt.wantMsg {
+				t.Errorf("got %v\nwant %v", got, tt.wantMsg)
+			}
+			if err == nil && res.Name != "hello" {
+				t.Errorf("got %v\nwant %v", res.Name, "hello")
+			}
+		})
+	}
+}
+
+func TestHandlerMutatesRequest(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	m := ts.Method("ListFeatures")
+	ts.Method("GetFeature").Handler(func(r *Request) *Response {
+		r.Message["latitude"] = float64(999)
+		r.Headers.Set("x-mutated", "true")
+		return NewResponse()
+	})
+	m.Handler(func(r *Request) *Response {
+		lo, _ := r.Struct("lo")
+		lo["latitude"] = float64(999)
+		return NewResponse()
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	if _, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 10}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.ListFeatures(ctx, &routeguide.Rectangle{Lo: &routeguide.Point{Latitude: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+
+	rs := ts.Requests()
+	if got, want := len(rs), 2; got != want {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if got, want := rs[0].Message["latitude"], float64(10); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	if rs[0].HasHeader("x-mutated") {
+		t.Error("recorded headers are mutated")
+	}
+	for _, r := range []*Request{rs[1], m.Requests()[0]} {
+		lo, _ := r.Struct("lo")
+		if got, want := lo["latitude"], float64(10); got != want {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/route_guide.proto")
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	tb := &recordTB{}
+	ts.t = tb
+	ts.Method("GetFeature").Handler(func(r *Request) *Response {
+		_ = r.Message["name"].(string) // Point has no name field, so the type assertion panics
+		return NewResponse()
+	})
+	ts.Unmatched(func(r *Request, md protoreflect.MethodDescriptor) *Response {
+		panic("unmatched")
+	})
+
+	client := routeguide.NewRouteGuideClient(ts.Conn())
+	tests := []struct {
+		name        string
+		call        func() error
+		wantMessage string
+	}{
+		{"handler", func() error {
+			_, err := client.GetFeature(ctx, &routeguide.Point{Latitude: 10})
+			return err
+		}, "handler for routeguide.RouteGuide/GetFeature panicked: interface conversion"},
+		{"unmatched", func() error {
+			stream, err := client.RecordRoute(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = stream.CloseAndRecv()
+			return err
+		}, "handler for routeguide.RouteGuide/RecordRoute panicked: unmatched"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			s, _ := status.FromError(err)
+			if got, want := s.Code(), codes.Internal; got != want {
+				t.Errorf("got %v\nwant %v", got, want)
+			}
+			if got := s.Message(); !strings.Contains(got, tt.wantMessage) {
+				t.Errorf("got %v\nwant to contain %v", got, tt.wantMessage)
+			}
+		})
+	}
+	if got, want := len(tb.errors), 2; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestUnaryMatchEnumOtherMethod(t *testing.T) {
+	ctx := context.Background()
+	ts := NewServer(t, "testdata/enum.proto", Proto("testdata/route_guide.proto"))
+	t.Cleanup(func() {
+		ts.Close()
+	})
+	// The enum path is not a field of routeguide.Point, so GetFeature does not match it without reporting errors.
+	ts.MatchEnum("brush.color", "COLOR_RED").Method("Paint").Response(map[string]any{"result": "matched"})
+	ts.Method("GetFeature").Response(map[string]any{"name": "hello"})
+	res, err := routeguide.NewRouteGuideClient(ts.Conn()).GetFeature(ctx, &routeguide.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Name, "hello"; got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	got, err := invoke(t, ts, "/enumtest.EnumService/Paint", `{"brush": {"color": "COLOR_RED"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["result"] != "matched" {
+		t.Errorf("got %v\nwant %v", got["result"], "matched")
+	}
+}